@@ -0,0 +1,252 @@
+package dbrx
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// conn is the *sql.DB of a session or the *sql.Tx of a transaction
+type conn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// runner runs SQL with bind parameters on a conn, reporting to the event
+// receiver and applying the timeout of its session, like dbr does
+type runner struct {
+	conn    conn
+	log     dbr.EventReceiver
+	timeout time.Duration
+}
+
+func newRunner(c conn, log dbr.EventReceiver, timeout time.Duration) *runner {
+	if log == nil {
+		log = &dbr.NullEventReceiver{}
+	}
+	return &runner{c, log, timeout}
+}
+
+func runnerOf(dml DML) *runner {
+	switch dml := dml.(type) {
+	case *wrapper:
+		return newRunner(dml.Session, dml.Session.EventReceiver, dml.Session.Timeout)
+	case outerTransaction:
+		return newRunner(dml.Tx, dml.Tx.EventReceiver, dml.Tx.Timeout)
+	case innerTransaction:
+		return newRunner(dml.Tx, dml.Tx.EventReceiver, dml.Tx.Timeout)
+	case scopedDML:
+		return runnerOf(dml.DML)
+	}
+	return nil
+}
+
+// queryContext runs the query built by b. The values are sent as bind
+// parameters, unless the dialect options ask for interpolation. As in dbr, the
+// session timeout isn't applied, since the rows outlive the call.
+func queryContext(ctx context.Context, dml DML, d dbr.Dialect, b dbr.Builder) (*sql.Rows, error) {
+	r := runnerOf(dml)
+	if r == nil || optionsFor(d).Interpolate {
+		str, err := interpolate(b, d)
+		if err != nil {
+			return nil, err
+		}
+		return dml.SelectBySql(str).RowsContext(ctx)
+	}
+	return r.query(ctx, b, d)
+}
+
+// loadContext runs the query built by b, like queryContext, and loads its rows
+// into value within the session timeout
+func loadContext(ctx context.Context, dml DML, d dbr.Dialect, b dbr.Builder, value interface{}) (int, error) {
+	r := runnerOf(dml)
+	if r == nil || optionsFor(d).Interpolate {
+		str, err := interpolate(b, d)
+		if err != nil {
+			return 0, err
+		}
+		return dml.SelectBySql(str).LoadContext(ctx, value)
+	}
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	rows, err := r.query(ctx, b, d)
+	if err != nil {
+		return 0, err
+	}
+	return dbr.Load(rows, value)
+}
+
+func (r *runner) query(ctx context.Context, b dbr.Builder, d dbr.Dialect) (*sql.Rows, error) {
+	query, args, err := bind(b, d)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	defer func() {
+		r.log.TimingKv("dbr.select", time.Since(start).Nanoseconds(), map[string]string{"sql": query})
+	}()
+	rows, err := r.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, r.log.EventErrKv("dbr.select.load.query", err, map[string]string{"sql": query})
+	}
+	return rows, nil
+}
+
+// execContext runs the statement built by b, like queryContext
+func execContext(ctx context.Context, dml DML, d dbr.Dialect, b dbr.Builder) (sql.Result, error) {
+	r := runnerOf(dml)
+	if r == nil || optionsFor(d).Interpolate {
+		str, err := interpolate(b, d)
+		if err != nil {
+			return nil, err
+		}
+		return dml.UpdateBySql(str).ExecContext(ctx)
+	}
+	query, args, err := bind(b, d)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	defer func() {
+		r.log.TimingKv("dbr.exec", time.Since(start).Nanoseconds(), map[string]string{"sql": query})
+	}()
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	result, err := r.conn.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, r.log.EventErrKv("dbr.exec.exec", err, map[string]string{"sql": query})
+	}
+	return result, nil
+}
+
+func interpolate(b dbr.Builder, d dbr.Dialect) (string, error) {
+	buf := dbr.NewBuffer()
+	err := b.Build(d, buf)
+	if err != nil {
+		return "", err
+	}
+	return dbr.InterpolateForDialect(buf.String(), buf.Value(), d)
+}
+
+// bind builds b and returns its SQL, with the dialect placeholders, and its
+// bind parameters. Builder values are written inline, in parentheses if they
+// are queries, and slices are expanded to lists, as dbr interpolation does.
+func bind(b dbr.Builder, d dbr.Dialect) (string, []interface{}, error) {
+	buf := dbr.NewBuffer()
+	err := b.Build(d, buf)
+	if err != nil {
+		return "", nil, err
+	}
+	var query strings.Builder
+	var args []interface{}
+	err = expand(d, &query, &args, buf.String(), buf.Value())
+	return query.String(), args, err
+}
+
+func expand(d dbr.Dialect, query *strings.Builder, args *[]interface{}, str string, value []interface{}) error {
+	arg := func(v interface{}) {
+		query.WriteString(d.Placeholder(len(*args)))
+		*args = append(*args, v)
+	}
+	for {
+		i := indexPlaceholder(str)
+		if i < 0 {
+			break
+		}
+		if len(value) == 0 {
+			return ErrPlaceholderCount
+		}
+		query.WriteString(str[:i])
+		str = str[i+len(placeholder):]
+		v := value[0]
+		value = value[1:]
+
+		switch v := v.(type) {
+		case dbr.Builder:
+			buf := dbr.NewBuffer()
+			err := v.Build(d, buf)
+			if err != nil {
+				return err
+			}
+			_, union := v.(*UnionStmt)
+			paren := union || isQuery(buf.String())
+			if paren {
+				query.WriteString("(")
+			}
+			err = expand(d, query, args, buf.String(), buf.Value())
+			if err != nil {
+				return err
+			}
+			if paren {
+				query.WriteString(")")
+			}
+			continue
+		case driver.Valuer, []byte:
+			arg(v)
+			continue
+		}
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Slice {
+			arg(v)
+			continue
+		}
+		if rv.Len() == 0 {
+			query.WriteString("(NULL)")
+			continue
+		}
+		query.WriteString("(")
+		for j := 0; j < rv.Len(); j++ {
+			if j > 0 {
+				query.WriteString(",")
+			}
+			arg(rv.Index(j).Interface())
+		}
+		query.WriteString(")")
+	}
+	if len(value) > 0 {
+		return ErrPlaceholderCount
+	}
+	query.WriteString(str)
+	return nil
+}
+
+// indexPlaceholder returns the index of the first placeholder in str, or -1,
+// skipping quoted strings and identifiers, as dbr interpolation does
+func indexPlaceholder(str string) int {
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; c {
+		case '\'', '"', '`':
+			j := strings.IndexByte(str[i+1:], c)
+			if j < 0 {
+				return -1
+			}
+			i += j + 1
+		case placeholder[0]:
+			return i
+		}
+	}
+	return -1
+}
+
+// isQuery tells if the SQL is a query, which must be in parentheses when
+// used as a value
+func isQuery(str string) bool {
+	str = strings.ToUpper(strings.TrimSpace(str))
+	for _, prefix := range []string{"SELECT ", "WITH ", "VALUES "} {
+		if strings.HasPrefix(str, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,301 @@
+package dbrx
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// RowsLoader is implemented by the statements that return their rows, like
+// *SelectStmt, *UnionStmt and the *dbr.SelectStmt returned by SelectBySql
+type RowsLoader interface {
+	RowsContext(ctx context.Context) (*sql.Rows, error)
+}
+
+// Cursor iterates over the rows of a query, one at a time, instead of
+// loading all of them in memory
+//
+//	c, err := dml.Select("*").From("t").Iter(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	for c.Next() {
+//		var row Row
+//		if err := c.Scan(&row); err != nil {
+//			return err
+//		}
+//	}
+//	return c.Err()
+type Cursor struct {
+	ctx     context.Context
+	rows    *sql.Rows
+	columns []string
+	err     error
+	closed  bool
+
+	// set for server side cursors
+	fetch     func(ctx context.Context) (*sql.Rows, error)
+	close     func(ctx context.Context) error
+	fetchSize int
+	fetched   int
+}
+
+// Iter runs q and returns a cursor over its rows
+func Iter(ctx context.Context, q RowsLoader) (*Cursor, error) {
+	rows, err := q.RowsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{ctx: ctx, rows: rows}, nil
+}
+
+// Iter runs the query and returns a cursor over its rows
+func (b *SelectStmt) Iter(ctx context.Context) (*Cursor, error) {
+	return Iter(ctx, b)
+}
+
+var cursorSeq int64
+
+// DeclareCursor runs the query with a PostgreSQL server side cursor, which
+// fetches fetchSize rows at a time. It must be called inside a transaction.
+// The other dialects, which don't keep the results on the server, use Iter.
+func (b *SelectStmt) DeclareCursor(ctx context.Context, fetchSize int) (*Cursor, error) {
+	if !isPostgres(b.Dialect) {
+		return b.Iter(ctx)
+	}
+	if _, ok := asTX(b.dml); !ok {
+		return nil, ErrNotInTransaction
+	}
+	if fetchSize <= 0 {
+		return nil, ErrInvalidValue
+	}
+	name := "dbrx_cursor_" + strconv.FormatInt(atomic.AddInt64(&cursorSeq, 1), 10)
+	declare := dbr.BuildFunc(func(d dbr.Dialect, buf dbr.Buffer) error {
+		buf.WriteString("DECLARE " + name + " NO SCROLL CURSOR FOR ")
+		return b.Build(d, buf)
+	})
+	_, err := execContext(ctx, b.dml, b.Dialect, declare)
+	if err != nil {
+		return nil, err
+	}
+	fetch := func(ctx context.Context) (*sql.Rows, error) {
+		return b.dml.SelectBySql(fmt.Sprintf("FETCH FORWARD %d FROM %s", fetchSize, name)).RowsContext(ctx)
+	}
+	rows, err := fetch(ctx)
+	if err != nil {
+		b.dml.UpdateBySql("CLOSE " + name).ExecContext(ctx)
+		return nil, err
+	}
+	return &Cursor{
+		ctx:       ctx,
+		rows:      rows,
+		fetch:     fetch,
+		fetchSize: fetchSize,
+		close: func(ctx context.Context) error {
+			_, err := b.dml.UpdateBySql("CLOSE " + name).ExecContext(ctx)
+			return err
+		},
+	}, nil
+}
+
+// Next prepares the next row to be scanned. It returns false, closing the
+// cursor, when there are no more rows, an error happens or the context is
+// done.
+func (c *Cursor) Next() bool {
+	if c.closed {
+		return false
+	}
+	for {
+		if err := c.ctx.Err(); err != nil {
+			c.err = err
+			c.Close()
+			return false
+		}
+		if c.rows.Next() {
+			c.fetched++
+			return true
+		}
+		if err := c.rows.Err(); err != nil {
+			c.err = err
+			c.Close()
+			return false
+		}
+		if c.fetch == nil || c.fetched < c.fetchSize {
+			c.Close()
+			return false
+		}
+		c.rows.Close()
+		rows, err := c.fetch(c.ctx)
+		if err != nil {
+			c.err = err
+			c.Close()
+			return false
+		}
+		c.rows, c.columns, c.fetched = rows, nil, 0
+	}
+}
+
+// Scan copies the current row into dest, which is a pointer to a struct,
+// mapped like dbr does, or to a value for single column rows
+func (c *Cursor) Scan(dest interface{}) error {
+	if c.columns == nil {
+		columns, err := c.rows.Columns()
+		if err != nil {
+			return err
+		}
+		c.columns = columns
+	}
+	targets, err := scanTargets(dest, c.columns)
+	if err != nil {
+		return err
+	}
+	return c.rows.Scan(targets...)
+}
+
+// Err returns the error, if any, that stopped the iteration
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Close closes the cursor, with the context it was created with. It may be
+// called more than once.
+func (c *Cursor) Close() error {
+	return c.CloseContext(c.ctx)
+}
+
+// CloseContext closes the cursor. Server side cursors are closed with ctx.
+// It may be called more than once.
+func (c *Cursor) CloseContext(ctx context.Context) error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	err := c.rows.Close()
+	if c.close != nil {
+		if closeErr := c.close(ctx); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+var (
+	scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+	fieldsCache sync.Map // map[reflect.Type]*structInfo
+)
+
+// scanTargets returns a pointer to scan each column into dest. Columns
+// without a matching field are discarded.
+func scanTargets(dest interface{}, columns []string) ([]interface{}, error) {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, ErrInvalidPointer
+	}
+	v = v.Elem()
+	if !isStruct(v.Type()) {
+		if len(columns) != 1 {
+			return nil, fmt.Errorf("dbrx: can't scan %d columns into %v", len(columns), v.Type())
+		}
+		return []interface{}{dest}, nil
+	}
+	fields := structFields(v.Type())
+	targets := make([]interface{}, len(columns))
+	for i, col := range columns {
+		index, ok := fields[col]
+		if !ok {
+			targets[i] = new(interface{})
+			continue
+		}
+		targets[i] = fieldByIndex(v, index).Addr().Interface()
+	}
+	return targets, nil
+}
+
+func isStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t != timeType && !reflect.PtrTo(t).Implements(scannerType)
+}
+
+type structInfo struct {
+	// columns are in field order
+	columns []string
+	fields  map[string][]int
+}
+
+// structFields maps column names to struct fields, using the db tag or the
+// dbr.NameMapping of the field name, and flattening embedded structs, as
+// dbr.Load does. dbr has no exported way to scan a single row, which cursors
+// need to stream their rows.
+func structFields(t reflect.Type) map[string][]int {
+	return mapStruct(t).fields
+}
+
+// structColumns returns the column names of the struct fields
+func structColumns(t reflect.Type) []string {
+	return mapStruct(t).columns
+}
+
+func mapStruct(t reflect.Type) *structInfo {
+	if info, ok := fieldsCache.Load(t); ok {
+		return info.(*structInfo)
+	}
+	info := &structInfo{fields: make(map[string][]int)}
+	var walk func(t reflect.Type, index []int)
+	walk = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" && !field.Anonymous {
+				continue
+			}
+			tag := field.Tag.Get("db")
+			if tag == "-" {
+				continue
+			}
+			fieldIndex := append(append([]int{}, index...), i)
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if field.Anonymous && tag == "" && isStruct(fieldType) {
+				walk(fieldType, fieldIndex)
+				continue
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			name := tag
+			if name == "" {
+				name = dbr.NameMapping(field.Name)
+			}
+			if _, ok := info.fields[name]; !ok {
+				info.fields[name] = fieldIndex
+				info.columns = append(info.columns, name)
+			}
+		}
+	}
+	walk(t, nil)
+	fieldsCache.Store(t, info)
+	return info
+}
+
+// fieldByIndex returns the nested field, allocating nil embedded pointers
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
@@ -6,8 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gocraft/dbr/v2"
@@ -50,16 +54,23 @@ type DML interface {
 	Select(...string) *SelectStmt
 	InsertInto(string) *InsertStmt
 	Update(string) *UpdateStmt
-	DeleteFrom(string) *dbr.DeleteStmt
+	DeleteFrom(string) *DeleteStmt
 	Begin() (TX, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (TX, error)
 	Exec(sql string, args ...interface{}) (sql.Result, error)
 	With(name string, builder dbr.Builder) DML
+	WithRecursive(name string, builder dbr.Builder, column ...string) DML
+	WithOptions(name string, builder dbr.Builder, opts CTEOptions) DML
 	Greatest(value ...interface{}) dbr.Builder
 	Union(builders ...dbr.Builder) *UnionStmt
+	UnionAll(builders ...dbr.Builder) *UnionStmt
 	RunAfterCommit(func()) error
+	RunAfterRollback(func()) error
+	RunBeforeCommit(func() error) error
 	UpdateBySql(sql string) *dbr.UpdateBuilder
 	SelectBySql(sql string, value ...interface{}) *dbr.SelectBuilder
 	InsertBySql(sql string, value ...interface{}) *dbr.InsertStmt
+	DeleteBySql(sql string, value ...interface{}) *dbr.DeleteStmt
 	TranslateString(text, regex, replace string) string
 	Translate(text, regex, replace string) dbr.Builder
 }
@@ -72,12 +83,17 @@ type TX interface {
 	RollbackUnlessCommitted()
 }
 
+// AfterCommitEventReceiver runs the functions added to it on the next commit
+// of the session
 type AfterCommitEventReceiver struct {
 	*dbr.NullEventReceiver
+	mu    sync.Mutex
 	funcs []func()
 }
 
 func (er *AfterCommitEventReceiver) Add(f func()) {
+	er.mu.Lock()
+	defer er.mu.Unlock()
 	er.funcs = append(er.funcs, f)
 }
 
@@ -85,34 +101,203 @@ func (er *AfterCommitEventReceiver) Event(eventName string) {
 	if eventName != "dbr.commit" {
 		return
 	}
-	for _, f := range er.funcs {
+	er.mu.Lock()
+	funcs := er.funcs
+	er.funcs = nil
+	er.mu.Unlock()
+	for _, f := range funcs {
 		f()
 	}
 }
 
 type withClauses []withClause
 
-type wrapper struct {
-	Session     *dbr.Session
+// merge returns ws followed by the clauses of other with a new name. The
+// branches of a union built by the same scope share their clauses, while
+// different clauses with the same name are an ErrWithConflict.
+func (ws withClauses) merge(d dbr.Dialect, other withClauses) (withClauses, error) {
+	merged := ws[:len(ws):len(ws)]
+outer:
+	for _, o := range other {
+		for _, w := range merged {
+			if w.name != o.name {
+				continue
+			}
+			same, err := w.equal(d, o)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				return nil, ErrWithConflict
+			}
+			continue outer
+		}
+		merged = append(merged, o)
+	}
+	return merged, nil
+}
+
+// scopedDML is returned by With. The statements it builds are preceded by
+// its with clauses, while the DML it was created from is left unchanged, so
+// both can be shared by goroutines.
+type scopedDML struct {
+	DML
 	withClauses withClauses
 }
 
+// asTX returns dml as a transaction, if it is one or a scope of one
+func asTX(dml DML) (TX, bool) {
+	for {
+		s, ok := dml.(scopedDML)
+		if !ok {
+			break
+		}
+		dml = s.DML
+	}
+	tx, ok := dml.(TX)
+	return tx, ok
+}
+
+func (s scopedDML) With(name string, builder dbr.Builder) DML {
+	return s.WithOptions(name, builder, CTEOptions{})
+}
+
+func (s scopedDML) WithRecursive(name string, builder dbr.Builder, column ...string) DML {
+	return s.WithOptions(name, builder, CTEOptions{Recursive: true, Columns: column})
+}
+
+func (s scopedDML) WithOptions(name string, builder dbr.Builder, opts CTEOptions) DML {
+	// the slice is copied, so the scopes built from s don't share clauses
+	ws := make(withClauses, len(s.withClauses), len(s.withClauses)+1)
+	copy(ws, s.withClauses)
+	return scopedDML{s.DML, append(ws, withClause{name, builder, opts})}
+}
+
+func (s scopedDML) Select(column ...string) *SelectStmt {
+	stmt := s.DML.Select(column...)
+	stmt.withClauses = s.withClauses
+	return stmt
+}
+
+func (s scopedDML) InsertInto(table string) *InsertStmt {
+	stmt := s.DML.InsertInto(table)
+	stmt.withClauses = s.withClauses
+	return stmt
+}
+
+func (s scopedDML) Update(table string) *UpdateStmt {
+	stmt := s.DML.Update(table)
+	stmt.withClauses = s.withClauses
+	return stmt
+}
+
+func (s scopedDML) DeleteFrom(table string) *DeleteStmt {
+	stmt := s.DML.DeleteFrom(table)
+	stmt.withClauses = s.withClauses
+	return stmt
+}
+
+func (s scopedDML) Union(builders ...dbr.Builder) *UnionStmt {
+	stmt := s.DML.Union(builders...)
+	stmt.withClauses = s.withClauses
+	return stmt
+}
+
+func (s scopedDML) UnionAll(builders ...dbr.Builder) *UnionStmt {
+	stmt := s.DML.UnionAll(builders...)
+	stmt.withClauses = s.withClauses
+	return stmt
+}
+
+type wrapper struct {
+	Session *dbr.Session
+}
+
 type withClause struct {
 	name    string
 	builder dbr.Builder
+	CTEOptions
+}
+
+// equal tells if both clauses have the same options and build the same SQL
+// and values
+func (w withClause) equal(d dbr.Dialect, o withClause) (bool, error) {
+	if !reflect.DeepEqual(w.CTEOptions, o.CTEOptions) {
+		return false, nil
+	}
+	wbuf, obuf := dbr.NewBuffer(), dbr.NewBuffer()
+	err := w.builder.Build(d, wbuf)
+	if err != nil {
+		return false, err
+	}
+	err = o.builder.Build(d, obuf)
+	if err != nil {
+		return false, err
+	}
+	return wbuf.String() == obuf.String() && reflect.DeepEqual(wbuf.Value(), obuf.Value()), nil
+}
+
+// CTEOptions are the options of a with clause, or common table expression
+type CTEOptions struct {
+	// Recursive lets the builder refer to the with clause itself, as in
+	// a UNION ALL of the root rows and a select joining the with clause
+	Recursive bool
+	// Columns names the columns of the with clause
+	Columns []string
+	// Materialization tells PostgreSQL whether to compute the with clause
+	// once. It is ignored by the other dialects.
+	Materialization Materialization
 }
 
+// Materialization is the PostgreSQL materialization hint of a with clause
+type Materialization int
+
+const (
+	// MaterializedAuto lets PostgreSQL decide
+	MaterializedAuto Materialization = iota
+	// Materialized computes the with clause once
+	Materialized
+	// NotMaterialized allows the with clause to be folded into the query
+	NotMaterialized
+)
+
 func (ws withClauses) write(d dbr.Dialect, buf dbr.Buffer) error {
 	if len(ws) == 0 {
 		return nil
 	}
 	buf.WriteString("WITH ")
+	// RECURSIVE applies to the whole list
+	for _, w := range ws {
+		if w.Recursive {
+			buf.WriteString("RECURSIVE ")
+			break
+		}
+	}
 	for i, w := range ws {
 		if i > 0 {
 			buf.WriteString(", ")
 		}
 		buf.WriteString(w.name)
-		buf.WriteString(" AS (")
+		if len(w.Columns) > 0 {
+			buf.WriteString("(")
+			for j, col := range w.Columns {
+				if j > 0 {
+					buf.WriteString(", ")
+				}
+				buf.WriteString(d.QuoteIdent(col))
+			}
+			buf.WriteString(")")
+		}
+		buf.WriteString(" AS ")
+		if isPostgres(d) {
+			switch w.Materialization {
+			case Materialized:
+				buf.WriteString("MATERIALIZED ")
+			case NotMaterialized:
+				buf.WriteString("NOT MATERIALIZED ")
+			}
+		}
+		buf.WriteString("(")
 		err := w.builder.Build(d, buf)
 		if err != nil {
 			return err
@@ -124,7 +309,7 @@ func (ws withClauses) write(d dbr.Dialect, buf dbr.Buffer) error {
 
 func newWrapper(s *dbr.Session) *wrapper {
 	if _, ok := s.Dialect.(dialect); !ok {
-		s.Dialect = dialect{s.Dialect}
+		s.Dialect = dialect{Dialect: s.Dialect}
 	}
 	return &wrapper{Session: s}
 }
@@ -134,24 +319,41 @@ func Wrap(s *dbr.Session) DML {
 	return newWrapper(s)
 }
 
+// WrapOptions wraps a *dbr.Session, like Wrap, building and running its
+// statements with opts. The options are kept by the session dialect, so the
+// transactions begun afterwards share them.
+func WrapOptions(s *dbr.Session, opts Options) DML {
+	s.Dialect = dialect{baseDialect(s.Dialect), opts}
+	return &wrapper{Session: s}
+}
+
 func (w *wrapper) Exec(sql string, args ...interface{}) (sql.Result, error) {
 	return w.Session.Exec(sql, args...)
 }
 
 func (w *wrapper) Begin() (TX, error) {
-	tx, err := w.Session.Begin()
-	return outerTransaction{Tx: tx, w: w}, err
+	return w.BeginTx(context.Background(), nil)
+}
+
+func (w *wrapper) BeginTx(ctx context.Context, opts *sql.TxOptions) (TX, error) {
+	tx, err := w.Session.BeginTx(ctx, opts)
+	return outerTransaction{Tx: tx, w: w, state: &txState{}}, err
 }
 
 func (w *wrapper) With(name string, builder dbr.Builder) DML {
-	w.withClauses = append(w.withClauses, withClause{name, builder})
-	return w
+	return w.WithOptions(name, builder, CTEOptions{})
+}
+
+func (w *wrapper) WithRecursive(name string, builder dbr.Builder, column ...string) DML {
+	return w.WithOptions(name, builder, CTEOptions{Recursive: true, Columns: column})
+}
+
+func (w *wrapper) WithOptions(name string, builder dbr.Builder, opts CTEOptions) DML {
+	return scopedDML{w, withClauses{{name, builder, opts}}}
 }
 
 func (w *wrapper) Select(column ...string) *SelectStmt {
-	stmt := &SelectStmt{w.Session.Select(column...), w.withClauses, w}
-	w.withClauses = nil
-	return stmt
+	return &SelectStmt{SelectStmt: w.Session.Select(column...), dml: w}
 }
 
 func (w *wrapper) InsertInto(table string) *InsertStmt {
@@ -159,13 +361,11 @@ func (w *wrapper) InsertInto(table string) *InsertStmt {
 }
 
 func (w *wrapper) Update(table string) *UpdateStmt {
-	stmt := &UpdateStmt{w.Session.Update(table), w.withClauses, w}
-	w.withClauses = nil
-	return stmt
+	return &UpdateStmt{UpdateStmt: w.Session.Update(table), dml: w}
 }
 
-func (w *wrapper) DeleteFrom(sql string) *dbr.DeleteStmt {
-	return w.Session.DeleteFrom(sql)
+func (w *wrapper) DeleteFrom(table string) *DeleteStmt {
+	return &DeleteStmt{DeleteStmt: w.Session.DeleteFrom(table), dml: w}
 }
 
 func (w *wrapper) UpdateBySql(sql string) *dbr.UpdateBuilder {
@@ -180,12 +380,21 @@ func (w *wrapper) InsertBySql(sql string, value ...interface{}) *dbr.InsertStmt
 	return w.Session.InsertBySql(sql, value...)
 }
 
+func (w *wrapper) DeleteBySql(sql string, value ...interface{}) *dbr.DeleteStmt {
+	return w.Session.DeleteBySql(sql, value...)
+}
+
 func (w *wrapper) Union(builders ...dbr.Builder) *UnionStmt {
-	return &UnionStmt{builders, w, false, w.Session.Dialect}
+	return newUnion(w, w.Session.Dialect, "UNION", builders)
+}
+
+func (w *wrapper) UnionAll(builders ...dbr.Builder) *UnionStmt {
+	return newUnion(w, w.Session.Dialect, "UNION ALL", builders)
 }
 
+type funcAdder interface{ Add(func()) }
+
 func (w *wrapper) RunAfterCommit(f func()) error {
-	type funcAdder interface{ Add(func()) }
 	if fa, ok := w.Session.EventReceiver.(funcAdder); !ok {
 		return errors.New("session does not have a AfterCommitEventReceiver")
 	} else {
@@ -194,18 +403,133 @@ func (w *wrapper) RunAfterCommit(f func()) error {
 	return nil
 }
 
+// RunAfterRollback is only available inside transactions
+func (w *wrapper) RunAfterRollback(f func()) error {
+	return ErrNotInTransaction
+}
+
+// RunBeforeCommit is only available inside transactions
+func (w *wrapper) RunBeforeCommit(f func() error) error {
+	return ErrNotInTransaction
+}
+
+// txState is shared by an outer transaction and all of its inner transactions
+type txState struct {
+	mu            sync.Mutex
+	savepoints    int
+	done          bool
+	beforeCommit  []func() error
+	afterCommit   []func()
+	afterRollback []func()
+}
+
+// hooksMark records how many hooks were registered when a savepoint was created
+type hooksMark struct {
+	beforeCommit, afterCommit, afterRollback int
+}
+
+func (s *txState) nextSavepoint() (string, hooksMark) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.savepoints++
+	return "dbrx_sp_" + strconv.Itoa(s.savepoints), hooksMark{
+		len(s.beforeCommit),
+		len(s.afterCommit),
+		len(s.afterRollback),
+	}
+}
+
+func (s *txState) addBeforeCommit(f func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.beforeCommit = append(s.beforeCommit, f)
+	return nil
+}
+
+func (s *txState) addAfterCommit(f func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.afterCommit = append(s.afterCommit, f)
+	return nil
+}
+
+func (s *txState) addAfterRollback(f func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return sql.ErrTxDone
+	}
+	s.afterRollback = append(s.afterRollback, f)
+	return nil
+}
+
+func (s *txState) takeBeforeCommit() []func() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	funcs := s.beforeCommit
+	s.beforeCommit = nil
+	return funcs
+}
+
+// finish marks the transaction as done and returns its pending hooks
+func (s *txState) finish() (afterCommit, afterRollback []func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	afterCommit, afterRollback = s.afterCommit, s.afterRollback
+	s.beforeCommit, s.afterCommit, s.afterRollback = nil, nil, nil
+	return afterCommit, afterRollback
+}
+
+// rollbackTo discards the hooks registered after m and returns the
+// RunAfterRollback ones, which must run now
+func (s *txState) rollbackTo(m hooksMark) []func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.beforeCommit) > m.beforeCommit {
+		s.beforeCommit = s.beforeCommit[:m.beforeCommit]
+	}
+	if len(s.afterCommit) > m.afterCommit {
+		s.afterCommit = s.afterCommit[:m.afterCommit]
+	}
+	if len(s.afterRollback) <= m.afterRollback {
+		return nil
+	}
+	funcs := append([]func(){}, s.afterRollback[m.afterRollback:]...)
+	s.afterRollback = s.afterRollback[:m.afterRollback]
+	return funcs
+}
+
+func runAll(funcs []func()) {
+	for _, f := range funcs {
+		f()
+	}
+}
+
 type outerTransaction struct {
 	*dbr.Tx
-	withClauses withClauses
-	w           *wrapper
+	w     *wrapper
+	state *txState
 }
 
 func (t outerTransaction) Begin() (TX, error) {
-	return innerTransaction{Tx: t.Tx}, nil
+	return beginSavepoint(context.Background(), t.Tx, t.w, t.state)
+}
+
+// BeginTx starts an inner transaction. Since a savepoint can't change the
+// transaction isolation, opts is ignored.
+func (t outerTransaction) BeginTx(ctx context.Context, opts *sql.TxOptions) (TX, error) {
+	return beginSavepoint(ctx, t.Tx, t.w, t.state)
 }
 
 func (t outerTransaction) Select(columns ...string) *SelectStmt {
-	return &SelectStmt{t.Tx.Select(columns...), t.withClauses, t}
+	return &SelectStmt{SelectStmt: t.Tx.Select(columns...), dml: t}
 }
 
 func (t outerTransaction) InsertInto(table string) *InsertStmt {
@@ -213,12 +537,23 @@ func (t outerTransaction) InsertInto(table string) *InsertStmt {
 }
 
 func (t outerTransaction) Update(table string) *UpdateStmt {
-	return &UpdateStmt{t.Tx.Update(table), t.withClauses, t}
+	return &UpdateStmt{UpdateStmt: t.Tx.Update(table), dml: t}
+}
+
+func (t outerTransaction) DeleteFrom(table string) *DeleteStmt {
+	return &DeleteStmt{DeleteStmt: t.Tx.DeleteFrom(table), dml: t}
 }
 
 func (t outerTransaction) With(name string, builder dbr.Builder) DML {
-	t.withClauses = append(t.withClauses, withClause{name, builder})
-	return t
+	return t.WithOptions(name, builder, CTEOptions{})
+}
+
+func (t outerTransaction) WithRecursive(name string, builder dbr.Builder, column ...string) DML {
+	return t.WithOptions(name, builder, CTEOptions{Recursive: true, Columns: column})
+}
+
+func (t outerTransaction) WithOptions(name string, builder dbr.Builder, opts CTEOptions) DML {
+	return scopedDML{t, withClauses{{name, builder, opts}}}
 }
 
 func (t outerTransaction) Greatest(value ...interface{}) dbr.Builder {
@@ -226,11 +561,70 @@ func (t outerTransaction) Greatest(value ...interface{}) dbr.Builder {
 }
 
 func (t outerTransaction) Union(builders ...dbr.Builder) *UnionStmt {
-	return &UnionStmt{builders, t, false, t.Tx.Dialect}
+	return newUnion(t, t.Tx.Dialect, "UNION", builders)
+}
+
+func (t outerTransaction) UnionAll(builders ...dbr.Builder) *UnionStmt {
+	return newUnion(t, t.Tx.Dialect, "UNION ALL", builders)
+}
+
+// Commit runs the functions registered with RunBeforeCommit, commits the
+// transaction and then runs the ones registered with RunAfterCommit. If a
+// RunBeforeCommit function or the commit fails, the transaction is rolled
+// back and the RunAfterRollback functions run instead.
+func (t outerTransaction) Commit() error {
+	for funcs := t.state.takeBeforeCommit(); len(funcs) > 0; funcs = t.state.takeBeforeCommit() {
+		for _, f := range funcs {
+			if err := f(); err != nil {
+				t.Rollback()
+				return err
+			}
+		}
+	}
+	err := t.Tx.Commit()
+	afterCommit, afterRollback := t.state.finish()
+	if err != nil {
+		runAll(afterRollback)
+		return err
+	}
+	runAll(afterCommit)
+	return nil
+}
+
+// Rollback rollbacks the transaction and runs the functions registered with
+// RunAfterRollback
+func (t outerTransaction) Rollback() error {
+	err := t.Tx.Rollback()
+	_, afterRollback := t.state.finish()
+	runAll(afterRollback)
+	return err
+}
+
+// RollbackUnlessCommitted rollbacks the transaction, running the functions
+// registered with RunAfterRollback, unless it was already committed
+func (t outerTransaction) RollbackUnlessCommitted() {
+	t.Tx.RollbackUnlessCommitted()
+	_, afterRollback := t.state.finish()
+	runAll(afterRollback)
 }
 
+// RunAfterCommit schedules f to run once, right after the transaction
+// commits. If the transaction is rolled back, f is discarded. Unlike the
+// session RunAfterCommit, it doesn't need an AfterCommitEventReceiver.
 func (t outerTransaction) RunAfterCommit(f func()) error {
-	return t.w.RunAfterCommit(f)
+	return t.state.addAfterCommit(f)
+}
+
+// RunAfterRollback schedules f to run once, right after the transaction is
+// rolled back. If the transaction commits, f is discarded.
+func (t outerTransaction) RunAfterRollback(f func()) error {
+	return t.state.addAfterRollback(f)
+}
+
+// RunBeforeCommit schedules f to run inside the transaction, right before it
+// commits. If f returns an error, the transaction is rolled back instead.
+func (t outerTransaction) RunBeforeCommit(f func() error) error {
+	return t.state.addBeforeCommit(f)
 }
 
 func (t outerTransaction) SelectBySql(sql string, value ...interface{}) *dbr.SelectBuilder {
@@ -253,19 +647,75 @@ func (t outerTransaction) Translate(text, regex, replace string) dbr.Builder {
 	return Translate(t.Tx.Dialect, text, regex, replace)
 }
 
+// innerTransaction is a transaction nested in another one, backed by a SAVEPOINT
 type innerTransaction struct {
 	*dbr.Tx
-	withClauses withClauses
-	w           *wrapper
+	w         *wrapper
+	state     *txState
+	savepoint *savepoint
+}
+
+type savepoint struct {
+	name string
+	mark hooksMark
+	done bool
+}
+
+func beginSavepoint(ctx context.Context, tx *dbr.Tx, w *wrapper, state *txState) (TX, error) {
+	sp := &savepoint{}
+	sp.name, sp.mark = state.nextSavepoint()
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT "+sp.name); err != nil {
+		return nil, err
+	}
+	return innerTransaction{Tx: tx, w: w, state: state, savepoint: sp}, nil
+}
+
+func (t innerTransaction) Begin() (TX, error) {
+	return beginSavepoint(context.Background(), t.Tx, t.w, t.state)
+}
+
+// BeginTx starts an inner transaction. Since a savepoint can't change the
+// transaction isolation, opts is ignored.
+func (t innerTransaction) BeginTx(ctx context.Context, opts *sql.TxOptions) (TX, error) {
+	return beginSavepoint(ctx, t.Tx, t.w, t.state)
+}
+
+// Commit releases the savepoint, keeping its changes in the enclosing transaction
+func (t innerTransaction) Commit() error {
+	if t.savepoint.done {
+		return sql.ErrTxDone
+	}
+	if _, err := t.Tx.Exec("RELEASE SAVEPOINT " + t.savepoint.name); err != nil {
+		return err
+	}
+	t.savepoint.done = true
+	return nil
+}
+
+// Rollback undoes every change made since the savepoint was created,
+// discarding the hooks registered since then, except for the
+// RunAfterRollback ones, which run
+func (t innerTransaction) Rollback() error {
+	if t.savepoint.done {
+		return sql.ErrTxDone
+	}
+	if _, err := t.Tx.Exec("ROLLBACK TO SAVEPOINT " + t.savepoint.name); err != nil {
+		return err
+	}
+	t.savepoint.done = true
+	runAll(t.state.rollbackTo(t.savepoint.mark))
+	return nil
 }
 
-func (t innerTransaction) Begin() (TX, error)     { return t, nil }
-func (innerTransaction) Commit() error            { return nil }
-func (innerTransaction) Rollback() error          { return nil }
-func (innerTransaction) RollbackUnlessCommitted() {}
+// RollbackUnlessCommitted rollbacks to the savepoint if it was not released
+func (t innerTransaction) RollbackUnlessCommitted() {
+	if !t.savepoint.done {
+		t.Rollback()
+	}
+}
 
 func (t innerTransaction) Select(columns ...string) *SelectStmt {
-	return &SelectStmt{t.Tx.Select(columns...), t.withClauses, t}
+	return &SelectStmt{SelectStmt: t.Tx.Select(columns...), dml: t}
 }
 
 func (t innerTransaction) InsertInto(table string) *InsertStmt {
@@ -273,12 +723,23 @@ func (t innerTransaction) InsertInto(table string) *InsertStmt {
 }
 
 func (t innerTransaction) Update(table string) *UpdateStmt {
-	return &UpdateStmt{t.Tx.Update(table), t.withClauses, t}
+	return &UpdateStmt{UpdateStmt: t.Tx.Update(table), dml: t}
+}
+
+func (t innerTransaction) DeleteFrom(table string) *DeleteStmt {
+	return &DeleteStmt{DeleteStmt: t.Tx.DeleteFrom(table), dml: t}
 }
 
 func (t innerTransaction) With(name string, builder dbr.Builder) DML {
-	t.withClauses = append(t.withClauses, withClause{name, builder})
-	return t
+	return t.WithOptions(name, builder, CTEOptions{})
+}
+
+func (t innerTransaction) WithRecursive(name string, builder dbr.Builder, column ...string) DML {
+	return t.WithOptions(name, builder, CTEOptions{Recursive: true, Columns: column})
+}
+
+func (t innerTransaction) WithOptions(name string, builder dbr.Builder, opts CTEOptions) DML {
+	return scopedDML{t, withClauses{{name, builder, opts}}}
 }
 
 func (t innerTransaction) Greatest(value ...interface{}) dbr.Builder {
@@ -286,15 +747,27 @@ func (t innerTransaction) Greatest(value ...interface{}) dbr.Builder {
 }
 
 func (t innerTransaction) Union(builders ...dbr.Builder) *UnionStmt {
-	return &UnionStmt{builders, t, false, t.Tx.Dialect}
+	return newUnion(t, t.Tx.Dialect, "UNION", builders)
+}
+
+func (t innerTransaction) UnionAll(builders ...dbr.Builder) *UnionStmt {
+	return newUnion(t, t.Tx.Dialect, "UNION ALL", builders)
 }
 
 func (t innerTransaction) RunAfterCommit(f func()) error {
-	return t.w.RunAfterCommit(f)
+	return t.state.addAfterCommit(f)
+}
+
+func (t innerTransaction) RunAfterRollback(f func()) error {
+	return t.state.addAfterRollback(f)
+}
+
+func (t innerTransaction) RunBeforeCommit(f func() error) error {
+	return t.state.addBeforeCommit(f)
 }
 
 func (t innerTransaction) SelectBySql(sql string, value ...interface{}) *dbr.SelectBuilder {
-	return t.Tx.SelectBySql(sql)
+	return t.Tx.SelectBySql(sql, value...)
 }
 
 func (t innerTransaction) UpdateBySql(sql string) *dbr.UpdateBuilder {
@@ -315,16 +788,55 @@ func (t innerTransaction) Translate(text, regex, replace string) dbr.Builder {
 
 // RunInTransaction calls f inside a transaction and rollbacks if it returns an error
 func RunInTransaction(dml DML, f func(tx TX) error) error {
-	tx, err := dml.Begin()
+	return RunInTransactionContext(
+		context.Background(),
+		dml,
+		nil,
+		func(_ context.Context, tx TX) error { return f(tx) },
+	)
+}
+
+// RunInTransactionContext calls f inside a transaction started with ctx and
+// opts, and rollbacks if f returns an error or ctx is done before the commit.
+// If f panics, the transaction is rolled back and the panic is propagated;
+// wrap f with RecoverPanic to get it as an error instead.
+func RunInTransactionContext(
+	ctx context.Context,
+	dml DML,
+	opts *sql.TxOptions,
+	f func(ctx context.Context, tx TX) error,
+) error {
+	tx, err := dml.BeginTx(ctx, opts)
 	if err != nil {
 		return err
 	}
-	defer tx.RollbackUnlessCommitted()
-	if err := f(tx); err != nil {
+	defer func() {
+		p := recover()
+		tx.RollbackUnlessCommitted()
+		if p != nil {
+			panic(p)
+		}
+	}()
+	if err := f(ctx, tx); err != nil {
 		return err
 	}
-	tx.Commit()
-	return nil
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecoverPanic wraps f so that a panic inside it is returned as a *PanicError,
+// carrying the panic value and stack trace
+func RecoverPanic(f func(ctx context.Context, tx TX) error) func(ctx context.Context, tx TX) error {
+	return func(ctx context.Context, tx TX) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = &PanicError{Value: p, Stack: debug.Stack()}
+			}
+		}()
+		return f(ctx, tx)
+	}
 }
 
 // SelectStmt overcomes dbr.SelectStmt limitations
@@ -332,290 +844,1337 @@ type SelectStmt struct {
 	*dbr.SelectStmt
 	withClauses withClauses
 	dml         DML
+	seek        *seek
+	err         error
+	distinctOn  []string
+	windows     []window
+	lock        *lock
+}
+
+type window struct {
+	name       string
+	definition string
 }
 
 // Build calls itself to build SQL.
 func (b *SelectStmt) Build(d dbr.Dialect, buf dbr.Buffer) error {
+	if b.err != nil {
+		return b.err
+	}
 	err := b.withClauses.write(d, buf)
 	if err != nil {
 		return err
 	}
-	return b.SelectStmt.Build(d, buf)
+	if b.plain() {
+		return b.SelectStmt.Build(d, buf)
+	}
+
+	// the clauses dbr lacks are written around a copy of the statement,
+	// without the ones that must follow them
+	stmt := *b.SelectStmt
+	stmt.Order = nil
+	stmt.LimitCount = -1
+	stmt.OffsetCount = -1
+	if len(b.distinctOn) > 0 {
+		if !isPostgres(d) {
+			return ErrNotSupported
+		}
+		stmt.IsDistinct = false
+		inner := dbr.NewBuffer()
+		err = stmt.Build(d, inner)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("SELECT DISTINCT ON (")
+		buf.WriteString(strings.Join(b.distinctOn, ", "))
+		buf.WriteString(") ")
+		buf.WriteString(strings.TrimPrefix(inner.String(), "SELECT "))
+		buf.WriteValue(inner.Value()...)
+	} else {
+		err = stmt.Build(d, buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(b.windows) > 0 {
+		buf.WriteString(" WINDOW ")
+		for i, w := range b.windows {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(d.QuoteIdent(w.name))
+			buf.WriteString(" AS (")
+			buf.WriteString(w.definition)
+			buf.WriteString(")")
+		}
+	}
+	if len(b.Order) > 0 {
+		buf.WriteString(" ORDER BY ")
+		for i, order := range b.Order {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			err = order.Build(d, buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if b.LimitCount >= 0 {
+		buf.WriteString(" LIMIT ")
+		buf.WriteString(strconv.FormatInt(b.LimitCount, 10))
+	}
+	if b.OffsetCount >= 0 {
+		buf.WriteString(" OFFSET ")
+		buf.WriteString(strconv.FormatInt(b.OffsetCount, 10))
+	}
+	if b.lock != nil {
+		return b.lock.write(d, buf, b.dml)
+	}
+	return nil
 }
 
-func (b *SelectStmt) From(table interface{}) *SelectStmt {
-	b.SelectStmt.From(table)
+// plain tells if dbr can build the statement by itself
+func (b *SelectStmt) plain() bool {
+	return len(b.distinctOn) == 0 && len(b.windows) == 0 && b.lock == nil
+}
+
+type lock struct {
+	strength string
+	of       []string
+	wait     string
+}
+
+func (l *lock) write(d dbr.Dialect, buf dbr.Buffer, dml DML) error {
+	if isSQLite(d) {
+		return ErrNotSupported
+	}
+	if _, ok := asTX(dml); !ok {
+		return ErrNotInTransaction
+	}
+	if l.strength == "" {
+		return ErrInvalidValue
+	}
+	buf.WriteString(" FOR ")
+	buf.WriteString(l.strength)
+	for i, table := range l.of {
+		if i == 0 {
+			buf.WriteString(" OF ")
+		} else {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(d.QuoteIdent(table))
+	}
+	if l.wait != "" {
+		buf.WriteString(" ")
+		buf.WriteString(l.wait)
+	}
+	return nil
+}
+
+func (b *SelectStmt) locking() *lock {
+	if b.lock == nil {
+		b.lock = &lock{}
+	}
+	return b.lock
+}
+
+// ForUpdate locks the selected rows against updates and deletes until the
+// end of the transaction. Locking clauses can only be used inside a
+// transaction and aren't supported by SQLite.
+func (b *SelectStmt) ForUpdate() *SelectStmt {
+	b.locking().strength = "UPDATE"
 	return b
 }
 
-func (b *SelectStmt) Join(table, on interface{}) *SelectStmt {
-	b.SelectStmt.Join(table, on)
+// ForNoKeyUpdate locks the selected rows like ForUpdate, but still allows
+// locks by ForKeyShare, as needed by foreign key checks
+func (b *SelectStmt) ForNoKeyUpdate() *SelectStmt {
+	b.locking().strength = "NO KEY UPDATE"
 	return b
 }
 
-func (b *SelectStmt) LeftJoin(table, on interface{}) *SelectStmt {
-	b.SelectStmt.LeftJoin(table, on)
+// ForShare locks the selected rows against updates and deletes, allowing
+// other transactions to share the lock
+func (b *SelectStmt) ForShare() *SelectStmt {
+	b.locking().strength = "SHARE"
 	return b
 }
 
-func (b *SelectStmt) Where(query interface{}, value ...interface{}) *SelectStmt {
-	b.SelectStmt.Where(query, value...)
+// ForKeyShare locks the selected rows against deletes and key updates
+func (b *SelectStmt) ForKeyShare() *SelectStmt {
+	b.locking().strength = "KEY SHARE"
+	return b
+}
+
+// Of restricts the locking clause to the rows of the given tables
+func (b *SelectStmt) Of(table ...string) *SelectStmt {
+	l := b.locking()
+	l.of = append(l.of, table...)
+	return b
+}
+
+// NoWait fails instead of waiting for rows locked by other transactions
+func (b *SelectStmt) NoWait() *SelectStmt {
+	b.locking().wait = "NOWAIT"
 	return b
 }
 
-func (b *SelectStmt) OrderBy(col string) *SelectStmt {
-	b.SelectStmt.OrderBy(col)
+// SkipLocked skips the rows locked by other transactions, as in a job queue:
+//
+//	tx.Select("*").From("jobs").OrderAsc("id").Limit(1).ForUpdate().SkipLocked()
+func (b *SelectStmt) SkipLocked() *SelectStmt {
+	b.locking().wait = "SKIP LOCKED"
+	return b
+}
+
+func (b *SelectStmt) From(table interface{}) *SelectStmt {
+	b.SelectStmt.From(table)
+	return b
+}
+
+func (b *SelectStmt) Distinct() *SelectStmt {
+	b.SelectStmt.Distinct()
+	return b
+}
+
+// DistinctOn keeps only the first row of each set of rows where the given
+// expressions are equal. It is only supported by PostgreSQL.
+func (b *SelectStmt) DistinctOn(col ...string) *SelectStmt {
+	b.distinctOn = append(b.distinctOn, col...)
+	return b
+}
+
+func (b *SelectStmt) Join(table, on interface{}) *SelectStmt {
+	b.SelectStmt.Join(table, on)
+	return b
+}
+
+func (b *SelectStmt) LeftJoin(table, on interface{}) *SelectStmt {
+	b.SelectStmt.LeftJoin(table, on)
+	return b
+}
+
+func (b *SelectStmt) RightJoin(table, on interface{}) *SelectStmt {
+	b.SelectStmt.RightJoin(table, on)
+	return b
+}
+
+func (b *SelectStmt) FullJoin(table, on interface{}) *SelectStmt {
+	b.SelectStmt.FullJoin(table, on)
+	return b
+}
+
+// CrossJoin joins every row of table
+func (b *SelectStmt) CrossJoin(table interface{}) *SelectStmt {
+	b.JoinTable = append(b.JoinTable, dbr.BuildFunc(func(d dbr.Dialect, buf dbr.Buffer) error {
+		buf.WriteString(" CROSS JOIN ")
+		return writeTable(d, buf, table)
+	}))
+	return b
+}
+
+// LateralJoin joins a subquery that can refer to the preceding tables, as
+// in LateralJoin(dml.Select("*").From("b").Where("b.a_id = a.id").As("b"), "true").
+// It is only supported by PostgreSQL.
+func (b *SelectStmt) LateralJoin(table, on interface{}) *SelectStmt {
+	b.JoinTable = append(b.JoinTable, dbr.BuildFunc(func(d dbr.Dialect, buf dbr.Buffer) error {
+		if !isPostgres(d) {
+			return ErrNotSupported
+		}
+		buf.WriteString(" JOIN LATERAL ")
+		err := writeTable(d, buf, table)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(" ON ")
+		switch on := on.(type) {
+		case string:
+			buf.WriteString(on)
+		case dbr.Builder:
+			buf.WriteString(placeholder)
+			buf.WriteValue(on)
+		}
+		return nil
+	}))
+	return b
+}
+
+// writeTable writes a table name, or a derived table built by As
+func writeTable(d dbr.Dialect, buf dbr.Buffer, table interface{}) error {
+	switch table := table.(type) {
+	case string:
+		buf.WriteString(d.QuoteIdent(table))
+	case *SelectStmt:
+		buf.WriteString("(")
+		err := table.Build(d, buf)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(")")
+	case dbr.Builder:
+		return table.Build(d, buf)
+	default:
+		return ErrInvalidValue
+	}
+	return nil
+}
+
+// As returns the query as a derived table named alias, to be used in From
+// and joins. The columns, if any, rename the query columns.
+func (b *SelectStmt) As(alias string, column ...string) dbr.Builder {
+	return As(b, alias, column...)
+}
+
+func (b *SelectStmt) Where(query interface{}, value ...interface{}) *SelectStmt {
+	b.SelectStmt.Where(query, value...)
+	return b
+}
+
+func (b *SelectStmt) GroupBy(col ...string) *SelectStmt {
+	b.SelectStmt.GroupBy(col...)
+	return b
+}
+
+func (b *SelectStmt) Having(query interface{}, value ...interface{}) *SelectStmt {
+	b.SelectStmt.Having(query, value...)
+	return b
+}
+
+// Window defines a named window, as in
+// Window("w", "PARTITION BY dept ORDER BY salary DESC"), to be used by the
+// columns' window functions: Select("rank() OVER w")
+func (b *SelectStmt) Window(name, definition string) *SelectStmt {
+	b.windows = append(b.windows, window{name, definition})
+	return b
+}
+
+func (b *SelectStmt) OrderBy(col string) *SelectStmt {
+	b.SelectStmt.OrderBy(col)
+	return b
+}
+
+func (b *SelectStmt) OrderAsc(col string) *SelectStmt {
+	b.SelectStmt.OrderAsc(col)
+	return b
+}
+
+func (b *SelectStmt) OrderDesc(col string) *SelectStmt {
+	b.SelectStmt.OrderDesc(col)
+	return b
+}
+
+func (b *SelectStmt) OrderDir(col string, isAsc bool) *SelectStmt {
+	b.SelectStmt.OrderDir(col, isAsc)
+	return b
+}
+
+func (b *SelectStmt) Limit(n uint64) *SelectStmt {
+	b.SelectStmt.Limit(n)
+	return b
+}
+
+func (b *SelectStmt) Offset(n uint64) *SelectStmt {
+	b.SelectStmt.Offset(n)
+	return b
+}
+
+func (b *SelectStmt) Paginate(page, perPage uint64) *SelectStmt {
+	b.SelectStmt.Paginate(page, perPage)
+	return b
+}
+
+func (b *SelectStmt) Load(value interface{}) (int, error) {
+	return b.LoadContext(context.Background(), value)
+}
+
+func (b *SelectStmt) LoadContext(ctx context.Context, value interface{}) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.direct() {
+		return b.SelectStmt.LoadContext(ctx, value)
+	}
+	return loadContext(ctx, b.dml, b.Dialect, b, value)
+}
+
+func (b *SelectStmt) LoadOne(value interface{}) error {
+	return b.LoadOneContext(context.Background(), value)
+}
+
+func (b *SelectStmt) LoadOneContext(ctx context.Context, value interface{}) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.direct() {
+		return b.SelectStmt.LoadOneContext(ctx, value)
+	}
+	n, err := b.LoadContext(ctx, value)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return dbr.ErrNotFound
+	}
+	return nil
+}
+
+// Rows runs the query and returns its rows, which must be closed
+func (b *SelectStmt) Rows() (*sql.Rows, error) {
+	return b.RowsContext(context.Background())
+}
+
+// RowsContext runs the query and returns its rows, which must be closed
+func (b *SelectStmt) RowsContext(ctx context.Context) (*sql.Rows, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.direct() {
+		return b.SelectStmt.RowsContext(ctx)
+	}
+	return queryContext(ctx, b.dml, b.Dialect, b)
+}
+
+func (b *SelectStmt) ReturnInt64() (int64, error) {
+	var v int64
+	err := b.LoadOne(&v)
+	return v, err
+}
+
+func (b *SelectStmt) ReturnInt64s() ([]int64, error) {
+	var v []int64
+	_, err := b.Load(&v)
+	return v, err
+}
+
+func (b *SelectStmt) ReturnUint64() (uint64, error) {
+	var v uint64
+	err := b.LoadOne(&v)
+	return v, err
+}
+
+func (b *SelectStmt) ReturnUint64s() ([]uint64, error) {
+	var v []uint64
+	_, err := b.Load(&v)
+	return v, err
+}
+
+func (b *SelectStmt) ReturnString() (string, error) {
+	var v string
+	err := b.LoadOne(&v)
+	return v, err
+}
+
+func (b *SelectStmt) ReturnStrings() ([]string, error) {
+	var v []string
+	_, err := b.Load(&v)
+	return v, err
+}
+
+// direct tells if b can be run by dbr. With clauses, and the clauses dbr
+// lacks, are run with bind parameters by queryContext.
+func (b *SelectStmt) direct() bool {
+	return len(b.withClauses) == 0 && b.plain()
+}
+
+// InsertStmt overcomes dbr.InsertStmt limitations
+type InsertStmt struct {
+	*dbr.InsertStmt
+	withClauses withClauses
+	query       *SelectStmt
+	onConflict  bool
+	name        interface{}
+	do          dbr.Builder
+	updateAll   bool
+	dontUpdate  []string
+	dml         DML
+	// recordColumns tells the columns were taken from the records
+	recordColumns bool
+	err           error
+}
+
+// Columns specifies the columns names
+func (b *InsertStmt) Columns(column ...string) *InsertStmt {
+	b.InsertStmt.Columns(column...)
+	return b
+}
+
+// Values adds a tuple to be inserted.
+// The order of the tuple should match Columns.
+func (b *InsertStmt) Values(value ...interface{}) *InsertStmt {
+	b.InsertStmt.Values(value...)
+	return b
+}
+
+// Select inserts the rows returned by query, instead of Values, as in
+// InsertInto("archive").Columns("id", "s").Select(dml.Select("id", "s").From("t"))
+func (b *InsertStmt) Select(query *SelectStmt) *InsertStmt {
+	b.query = query
+	return b
+}
+
+// Record adds a tuple with the fields of structValue matching Columns. If no
+// columns were specified, all the struct fields are inserted, except a zero
+// id, which is left for the database to assign. Those columns must be the
+// same for every record, or the statement fails with ErrColumnsMismatch. As
+// in dbr, if structValue is a pointer with an int64 id field, the field is
+// set to the LastInsertId of plain inserts.
+func (b *InsertStmt) Record(structValue interface{}) *InsertStmt {
+	v := reflect.ValueOf(structValue)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return b
+	}
+	if (len(b.Column) == 0 || b.recordColumns) && isStruct(v.Type()) {
+		var columns []string
+		for _, col := range structColumns(v.Type()) {
+			if col == "id" && zeroField(v, structFields(v.Type())[col]) {
+				continue
+			}
+			columns = append(columns, col)
+		}
+		if !b.recordColumns {
+			b.InsertStmt.Columns(columns...)
+			b.recordColumns = true
+		} else if !reflect.DeepEqual(columns, b.Column) {
+			b.err = ErrColumnsMismatch
+			return b
+		}
+	}
+	b.InsertStmt.Record(structValue)
+	return b
+}
+
+// zeroField tells if the field at index is zero or behind a nil pointer
+func zeroField(v reflect.Value, index []int) bool {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return true
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v.IsZero()
+}
+
+// Records adds a tuple for each struct in slice, like Record. The elements
+// are passed by reference, so the id of the last one is set as by Record.
+func (b *InsertStmt) Records(slice interface{}) *InsertStmt {
+	v := reflect.Indirect(reflect.ValueOf(slice))
+	if v.Kind() != reflect.Slice {
+		return b
+	}
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() != reflect.Ptr && elem.CanAddr() {
+			elem = elem.Addr()
+		}
+		b.Record(elem.Interface())
+	}
+	return b
+}
+
+// Returning specifies the returning columns. How they are returned depends
+// on the dialect ReturningMode.
+func (b *InsertStmt) Returning(column ...string) *InsertStmt {
+	b.InsertStmt.Returning(column...)
+	return b
+}
+
+// Exec runs the insert statement
+func (b *InsertStmt) Exec() (sql.Result, error) {
+	return b.ExecContext(context.Background())
+}
+
+// ExecContext runs the insert statement. The result is an *InsertResult.
+func (b *InsertStmt) ExecContext(ctx context.Context) (sql.Result, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if batches := b.batches(); len(batches) > 1 {
+		result := &InsertResult{}
+		err := b.runBatches(ctx, batches, func(ctx context.Context, batch *InsertStmt) error {
+			r, err := batch.ExecContext(ctx)
+			if err != nil {
+				return err
+			}
+			result.ids = append(result.ids, r.(*InsertResult).ids...)
+			result.rows += r.(*InsertResult).rows
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	if len(b.InsertStmt.ReturnColumn) == 1 && returningMode(b.Dialect) == ReturningNative {
+		var ids []int64
+		_, err := b.LoadContext(ctx, &ids)
+		if err != nil {
+			return nil, err
+		}
+		return &InsertResult{ids, int64(len(ids))}, nil
+	}
+	var result sql.Result
+	var err error
+	if !b.onConflict && len(b.InsertStmt.ReturnColumn) == 0 && len(b.withClauses) == 0 && b.query == nil {
+		result, err = b.InsertStmt.ExecContext(ctx)
+	} else {
+		result, err = execContext(ctx, b.dml, b.Dialect, b)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newInsertResult(result)
+}
+
+// Load runs the insert statement and loads the returning columns into value,
+// which may be a pointer to a struct, a scalar or a slice of them
+func (b *InsertStmt) Load(value interface{}) (int, error) {
+	return b.LoadContext(context.Background(), value)
+}
+
+// LoadContext runs the insert statement and loads the returning columns into
+// value, which may be a pointer to a struct, a scalar or a slice of them
+func (b *InsertStmt) LoadContext(ctx context.Context, value interface{}) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if batches := b.batches(); len(batches) > 1 {
+		count := 0
+		err := b.runBatches(ctx, batches, func(ctx context.Context, batch *InsertStmt) error {
+			n, err := batch.LoadContext(ctx, value)
+			count += n
+			return err
+		})
+		return count, err
+	}
+	if returningMode(b.Dialect) == ReturningEmulated {
+		return b.loadEmulated(ctx, value)
+	}
+	return loadContext(ctx, b.dml, b.Dialect, b, value)
+}
+
+// loadEmulated runs a single row insert and selects its returning columns by
+// the LastInsertId
+func (b *InsertStmt) loadEmulated(ctx context.Context, value interface{}) (int, error) {
+	if len(b.InsertStmt.Value) != 1 || b.onConflict {
+		return 0, ErrNotSupported
+	}
+	idColumn, err := lastInsertIDColumn(b.Dialect)
+	if err != nil && len(b.InsertStmt.ReturnColumn) > 0 {
+		return 0, err
+	}
+	result, err := execContext(ctx, b.dml, b.Dialect, b)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if len(b.InsertStmt.ReturnColumn) == 0 {
+		return 0, nil
+	}
+	d := b.Dialect
+	columns := make([]string, len(b.InsertStmt.ReturnColumn))
+	for i, col := range b.InsertStmt.ReturnColumn {
+		columns[i] = col
+		if col != "*" {
+			columns[i] = d.QuoteIdent(col)
+		}
+	}
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = ?",
+		strings.Join(columns, ", "),
+		d.QuoteIdent(b.Table),
+		idColumn,
+	)
+	return b.dml.SelectBySql(query, id).LoadContext(ctx, value)
+}
+
+// maxParams returns the limit on the parameters of a statement: the
+// SQLITE_MAX_VARIABLE_NUMBER default of SQLite before 3.32, as bundled by
+// the go-sqlite3 version required by this module, and the protocol limit for
+// PostgreSQL and the other dialects
+func maxParams(d dbr.Dialect) int {
+	if isSQLite(d) {
+		return 999
+	}
+	return 65535
+}
+
+// batches splits the tuples of b in statements under maxParams parameters
+func (b *InsertStmt) batches() []*InsertStmt {
+	max := maxParams(b.Dialect)
+	if len(b.Column) == 0 || len(b.InsertStmt.Value)*len(b.Column) <= max {
+		return []*InsertStmt{b}
+	}
+	size := max / len(b.Column)
+	var batches []*InsertStmt
+	for i := 0; i < len(b.InsertStmt.Value); i += size {
+		end := i + size
+		if end > len(b.InsertStmt.Value) {
+			end = len(b.InsertStmt.Value)
+		}
+		batch := *b
+		stmt := *b.InsertStmt
+		stmt.Value = stmt.Value[i:end]
+		if end < len(b.InsertStmt.Value) {
+			// the id of the last record is set by the last batch
+			stmt.RecordID = nil
+		}
+		batch.InsertStmt = &stmt
+		batches = append(batches, &batch)
+	}
+	return batches
+}
+
+// runBatches calls f for each batch inside a transaction
+func (b *InsertStmt) runBatches(
+	ctx context.Context,
+	batches []*InsertStmt,
+	f func(ctx context.Context, batch *InsertStmt) error,
+) error {
+	run := func(ctx context.Context, tx TX) error {
+		for _, batch := range batches {
+			// the batch must run with tx, which creates its dbr statement
+			stmt := tx.InsertInto(b.Table)
+			stmt.Column = batch.Column
+			stmt.Value = batch.InsertStmt.Value
+			stmt.ReturnColumn = batch.InsertStmt.ReturnColumn
+			stmt.RecordID = batch.RecordID
+			batch.InsertStmt = stmt.InsertStmt
+			batch.dml = tx
+			err := f(ctx, batch)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if tx, ok := asTX(b.dml); ok {
+		return run(ctx, tx)
+	}
+	return RunInTransactionContext(ctx, b.dml, nil, run)
+}
+
+// OnConflict implements the ON CONFLICT clause. A nil do means DO NOTHING.
+func (b *InsertStmt) OnConflict(name interface{}, do dbr.Builder) *InsertStmt {
+	b.onConflict = true
+	b.name = name
+	b.do = do
+	return b
+}
+
+// DoUpdateAll sets the ON CONFLICT action to update every inserted column,
+// except the conflict target and the excluded ones, with its new value
+func (b *InsertStmt) DoUpdateAll(exclude ...string) *InsertStmt {
+	b.onConflict = true
+	b.updateAll = true
+	b.dontUpdate = exclude
+	return b
+}
+
+// conflictTarget returns the ON CONFLICT column names
+func (b *InsertStmt) conflictTarget() []string {
+	switch name := b.name.(type) {
+	case string:
+		if name != "" {
+			return []string{name}
+		}
+	case []string:
+		return name
+	}
+	return nil
+}
+
+// doUpdateAll returns the DoUpdateAll action, or nil, meaning DO NOTHING, if
+// there is no column to update
+func (b *InsertStmt) doUpdateAll() dbr.Builder {
+	skip := make(map[string]bool)
+	for _, col := range append(b.conflictTarget(), b.dontUpdate...) {
+		skip[col] = true
+	}
+	do := DoUpdate()
+	for _, col := range b.Column {
+		if !skip[col] {
+			do.SetExcluded(col)
+		}
+	}
+	if len(do.Value) == 0 {
+		return nil
+	}
+	return do
+}
+
+// Build calls itself to build SQL.
+func (b *InsertStmt) Build(d dbr.Dialect, buf dbr.Buffer) error {
+	if b.err != nil {
+		return b.err
+	}
+	err := b.withClauses.write(d, buf)
+	if err != nil {
+		return err
+	}
+	if b.query != nil {
+		err = b.buildSelect(d, buf)
+	} else {
+		// RETURNING must follow the ON CONFLICT clause
+		stmt := *b.InsertStmt
+		stmt.ReturnColumn = nil
+		err = stmt.Build(d, buf)
+	}
+	if err != nil {
+		return err
+	}
+	if b.onConflict {
+		buf.WriteString(" ON CONFLICT")
+		if names := b.conflictTarget(); len(names) > 0 {
+			buf.WriteString(" (")
+			for i, n := range names {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				buf.WriteString(d.QuoteIdent(n))
+			}
+			buf.WriteString(")")
+		}
+		buf.WriteString(" DO ")
+		do := b.do
+		if b.updateAll {
+			do = b.doUpdateAll()
+		}
+		if do == nil {
+			buf.WriteString("NOTHING")
+		} else {
+			err = do.Build(d, buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if returningMode(d) == ReturningNative {
+		writeReturning(d, buf, b.InsertStmt.ReturnColumn)
+	}
+	return nil
+}
+
+// buildSelect writes INSERT ... SELECT
+func (b *InsertStmt) buildSelect(d dbr.Dialect, buf dbr.Buffer) error {
+	if b.Table == "" {
+		return ErrTableNotSpecified
+	}
+	buf.WriteString("INSERT INTO ")
+	buf.WriteString(d.QuoteIdent(b.Table))
+	if len(b.Column) > 0 {
+		buf.WriteString(" (")
+		for i, col := range b.Column {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(d.QuoteIdent(col))
+		}
+		buf.WriteString(")")
+	}
+	buf.WriteString(" ")
+	query := b.query
+	if b.onConflict && isSQLite(d) && len(query.WhereCond) == 0 {
+		// SQLite would parse ON CONFLICT as a join constraint
+		stmt := *query.SelectStmt
+		stmt.WhereCond = []dbr.Builder{dbr.Expr("true")}
+		query = query.copy(&stmt)
+	}
+	return query.Build(d, buf)
+}
+
+// UpdateStmt overcomes dbr.UpdateStmt limitations
+type UpdateStmt struct {
+	*dbr.UpdateStmt
+	withClauses withClauses
+	dml         DML
+	from        interface{}
+}
+
+// Build calls itself to build SQL. The columns are set in alphabetical order.
+func (b *UpdateStmt) Build(d dbr.Dialect, buf dbr.Buffer) error {
+	if b.Table == "" {
+		return ErrTableNotSpecified
+	}
+	if len(b.Value) == 0 {
+		return ErrColumnNotSpecified
+	}
+	// SQLite lacks UPDATE ... FROM, so each value is selected by a subquery
+	// correlated by the where conditions
+	correlated := b.from != nil && isSQLite(d)
+	if b.from != nil && !correlated && !isPostgres(d) {
+		return ErrNotSupported
+	}
+	err := b.withClauses.write(d, buf)
+	if err != nil {
+		return err
+	}
+	table := d.QuoteIdent(b.Table)
+	buf.WriteString("UPDATE ")
+	buf.WriteString(table)
+	buf.WriteString(" SET ")
+	column := make([]string, 0, len(b.Value))
+	for col := range b.Value {
+		column = append(column, col)
+	}
+	sort.Strings(column)
+	for i, col := range column {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(d.QuoteIdent(col))
+		buf.WriteString(" = ")
+		if correlated {
+			buf.WriteString("(SELECT ")
+		}
+		buf.WriteString(placeholder)
+		buf.WriteValue(b.Value[col])
+		if correlated {
+			buf.WriteString(" FROM ")
+			err = writeTable(d, buf, b.from)
+			if err != nil {
+				return err
+			}
+			err = writeWhere(d, buf, " WHERE ", b.WhereCond)
+			if err != nil {
+				return err
+			}
+			buf.WriteString(")")
+		}
+	}
+	// the conditions selecting the updated rows without the joined table
+	cond := b.WhereCond
+	if b.from != nil {
+		cond = []dbr.Builder{exists(b.from, b.WhereCond)}
+	}
+	if b.from != nil && !correlated {
+		buf.WriteString(" FROM ")
+		err = writeTable(d, buf, b.from)
+		if err != nil {
+			return err
+		}
+	}
+
+	// SQLite and PostgreSQL lack UPDATE ... LIMIT, so the rows are picked by
+	// a subquery on their physical ids
+	emulateLimit := b.LimitCount >= 0 && (isSQLite(d) || isPostgres(d))
+	if emulateLimit {
+		rowid := table + ".rowid"
+		if isPostgres(d) {
+			rowid = table + ".ctid"
+		}
+		buf.WriteString(" WHERE ")
+		buf.WriteString(rowid)
+		buf.WriteString(" IN (SELECT ")
+		buf.WriteString(rowid)
+		buf.WriteString(" FROM ")
+		buf.WriteString(table)
+		err = writeWhere(d, buf, " WHERE ", cond)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(" LIMIT ")
+		buf.WriteString(strconv.FormatInt(b.LimitCount, 10))
+		buf.WriteString(")")
+		// the joined rows must still match the updated ones
+		if b.from != nil && !correlated {
+			err = writeWhere(d, buf, " AND ", b.WhereCond)
+		}
+	} else if correlated {
+		err = writeWhere(d, buf, " WHERE ", cond)
+	} else {
+		err = writeWhere(d, buf, " WHERE ", b.WhereCond)
+	}
+	if err != nil {
+		return err
+	}
+	if returningMode(d) == ReturningNative {
+		writeReturning(d, buf, b.ReturnColumn)
+	}
+	if b.LimitCount >= 0 && !emulateLimit {
+		buf.WriteString(" LIMIT ")
+		buf.WriteString(strconv.FormatInt(b.LimitCount, 10))
+	}
+	return nil
+}
+
+// plain tells if dbr can run the statement by itself
+func (b *UpdateStmt) plain() bool {
+	return len(b.withClauses) == 0 &&
+		len(b.ReturnColumn) == 0 &&
+		b.from == nil &&
+		b.LimitCount < 0
+}
+
+// Set updates column with value.
+func (b *UpdateStmt) Set(column string, value interface{}) *UpdateStmt {
+	b.UpdateStmt.Set(column, value)
+	return b
+}
+
+// SetMap updates the columns with the values of m.
+func (b *UpdateStmt) SetMap(m map[string]interface{}) *UpdateStmt {
+	b.UpdateStmt.SetMap(m)
+	return b
+}
+
+// SetExpr updates column with an SQL expression, as in
+// SetExpr("updated_at", "now()") or SetExpr("name", "upper(?)", name).
+func (b *UpdateStmt) SetExpr(column, expr string, value ...interface{}) *UpdateStmt {
+	b.UpdateStmt.Set(column, dbr.Expr(expr, value...))
+	return b
+}
+
+// Increment adds n to column. Use a negative n to decrement it.
+func (b *UpdateStmt) Increment(column string, n interface{}) *UpdateStmt {
+	b.UpdateStmt.Set(column, dbr.Expr("? + ?", dbr.I(column), n))
+	return b
+}
+
+// From joins table, which the values and where conditions may refer to, as in
+// Update("t").Set("c", dbr.I("s.c")).From("s").Where("t.id = s.t_id").
+// table is a table name or a derived table built by As, like
+// As(Values(1, "a").Values(2, "b"), "s", "t_id", "c"). SQLite, which lacks
+// UPDATE ... FROM, gets the values from subqueries correlated by the where
+// conditions.
+func (b *UpdateStmt) From(table interface{}) *UpdateStmt {
+	b.from = table
+	return b
+}
+
+// Where adds a where condition.
+// query can be Builder or string. value is used only if query type is string.
+func (b *UpdateStmt) Where(query interface{}, value ...interface{}) *UpdateStmt {
+	b.UpdateStmt.Where(query, value...)
+	return b
+}
+
+// Limit updates at most n rows. SQLite and PostgreSQL don't support it, so
+// it is emulated by a subquery on the rowid or ctid of the table.
+func (b *UpdateStmt) Limit(n uint64) *UpdateStmt {
+	b.UpdateStmt.Limit(n)
+	return b
+}
+
+// Exec runs the update statement
+func (b *UpdateStmt) Exec() (sql.Result, error) {
+	if b.plain() {
+		return b.UpdateStmt.Exec()
+	}
+	return execContext(context.Background(), b.dml, b.Dialect, b)
+}
+
+// ExecContext runs the update statement
+func (b *UpdateStmt) ExecContext(ctx context.Context) (sql.Result, error) {
+	if b.plain() {
+		return b.UpdateStmt.ExecContext(ctx)
+	}
+	return execContext(ctx, b.dml, b.Dialect, b)
+}
+
+// Load runs the update statement and loads the returning columns into value,
+// which may be a pointer to a struct, a scalar or a slice of them
+func (b *UpdateStmt) Load(value interface{}) (int, error) {
+	return b.LoadContext(context.Background(), value)
+}
+
+// LoadContext runs the update statement and loads the returning columns into
+// value, which may be a pointer to a struct, a scalar or a slice of them
+func (b *UpdateStmt) LoadContext(ctx context.Context, value interface{}) (int, error) {
+	if returningMode(b.Dialect) != ReturningNative {
+		return 0, ErrNotSupported
+	}
+	return loadContext(ctx, b.dml, b.Dialect, b, value)
+}
+
+// Returning specifies the returning columns. They are only returned when
+// the dialect ReturningMode is ReturningNative.
+func (b *UpdateStmt) Returning(column ...string) *UpdateStmt {
+	b.UpdateStmt.Returning(column...)
+	return b
+}
+
+// DeleteStmt overcomes dbr.DeleteStmt limitations
+type DeleteStmt struct {
+	*dbr.DeleteStmt
+	withClauses  withClauses
+	returnColumn []string
+	dml          DML
+	using        interface{}
+}
+
+// Build calls itself to build SQL.
+func (b *DeleteStmt) Build(d dbr.Dialect, buf dbr.Buffer) error {
+	if b.Table == "" {
+		return ErrTableNotSpecified
+	}
+	// SQLite lacks DELETE ... USING, so the rows are selected by a
+	// subquery correlated by the where conditions
+	correlated := b.using != nil && isSQLite(d)
+	if b.using != nil && !correlated && !isPostgres(d) {
+		return ErrNotSupported
+	}
+	err := b.withClauses.write(d, buf)
+	if err != nil {
+		return err
+	}
+	buf.WriteString("DELETE FROM ")
+	buf.WriteString(d.QuoteIdent(b.Table))
+	if correlated {
+		err = writeWhere(d, buf, " WHERE ", []dbr.Builder{exists(b.using, b.WhereCond)})
+	} else {
+		if b.using != nil {
+			buf.WriteString(" USING ")
+			err = writeTable(d, buf, b.using)
+			if err != nil {
+				return err
+			}
+		}
+		err = writeWhere(d, buf, " WHERE ", b.WhereCond)
+	}
+	if err != nil {
+		return err
+	}
+	if returningMode(d) == ReturningNative {
+		writeReturning(d, buf, b.returnColumn)
+	}
+	if b.LimitCount >= 0 {
+		buf.WriteString(" LIMIT ")
+		buf.WriteString(strconv.FormatInt(b.LimitCount, 10))
+	}
+	return nil
+}
+
+// Where adds a where condition.
+// query can be Builder or string. value is used only if query type is string.
+func (b *DeleteStmt) Where(query interface{}, value ...interface{}) *DeleteStmt {
+	b.DeleteStmt.Where(query, value...)
 	return b
 }
 
-func (b *SelectStmt) OrderAsc(col string) *SelectStmt {
-	b.SelectStmt.OrderAsc(col)
+// Using joins table, which the where conditions may refer to, as in
+// DeleteFrom("t").Using("s").Where("t.id = s.t_id AND s.expired").
+// table is a table name or a derived table built by As. SQLite, which lacks
+// DELETE ... USING, gets the rows from a subquery correlated by the where
+// conditions.
+func (b *DeleteStmt) Using(table interface{}) *DeleteStmt {
+	b.using = table
 	return b
 }
 
-func (b *SelectStmt) OrderDesc(col string) *SelectStmt {
-	b.SelectStmt.OrderDesc(col)
+// Returning specifies the returning columns. They are only returned when
+// the dialect ReturningMode is ReturningNative.
+func (b *DeleteStmt) Returning(column ...string) *DeleteStmt {
+	b.returnColumn = column
 	return b
 }
 
-func (b *SelectStmt) Load(value interface{}) (int, error) {
-	if len(b.withClauses) == 0 {
-		return b.SelectStmt.Load(value)
-	}
-	buf := dbr.NewBuffer()
-	err := b.Build(b.Dialect, buf)
-	if err != nil {
-		return 0, err
-	}
-	str, err := dbr.InterpolateForDialect(
-		buf.String(),
-		buf.Value(),
-		b.Dialect,
-	)
-	if err != nil {
-		return 0, err
-	}
-	return b.dml.SelectBySql(str).Load(value)
-}
-
-// InsertStmt overcomes dbr.InsertStmt limitations
-type InsertStmt struct {
-	*dbr.InsertStmt
-	onConflict bool
-	name       interface{}
-	do         dbr.Builder
-	dml        DML
+// Exec runs the delete statement
+func (b *DeleteStmt) Exec() (sql.Result, error) {
+	return b.ExecContext(context.Background())
 }
 
-// Columns specifies the columns names
-func (b *InsertStmt) Columns(column ...string) *InsertStmt {
-	b.InsertStmt.Columns(column...)
-	return b
+// ExecContext runs the delete statement
+func (b *DeleteStmt) ExecContext(ctx context.Context) (sql.Result, error) {
+	if len(b.withClauses) == 0 && len(b.returnColumn) == 0 && b.using == nil {
+		return b.DeleteStmt.ExecContext(ctx)
+	}
+	return execContext(ctx, b.dml, b.Dialect, b)
 }
 
-// Values adds a tuple to be inserted.
-// The order of the tuple should match Columns.
-func (b *InsertStmt) Values(value ...interface{}) *InsertStmt {
-	b.InsertStmt.Values(value...)
-	return b
+// Load runs the delete statement and loads the returning columns into value
+func (b *DeleteStmt) Load(value interface{}) (int, error) {
+	return b.LoadContext(context.Background(), value)
 }
 
-// Returning specifies the returning columns for postgres.
-func (b *InsertStmt) Returning(column ...string) *InsertStmt {
-	if isPostgres(b.Dialect) {
-		b.InsertStmt.Returning(column...)
+// LoadContext runs the delete statement and loads the returning columns into value
+func (b *DeleteStmt) LoadContext(ctx context.Context, value interface{}) (int, error) {
+	if returningMode(b.Dialect) != ReturningNative {
+		return 0, ErrNotSupported
 	}
-	return b
+	return loadContext(ctx, b.dml, b.Dialect, b, value)
 }
 
-// Exec runs the insert statement
-func (b *InsertStmt) Exec() (sql.Result, error) {
-	if isPostgres(b.Dialect) && len(b.InsertStmt.ReturnColumn) == 1 {
-		var id int64
-		err := b.InsertStmt.Load(&id)
+// exists returns a condition selecting the rows matched by cond in from. It
+// correlates a joined table in the dialects that can't join it directly.
+func exists(from interface{}, cond []dbr.Builder) dbr.Builder {
+	return dbr.BuildFunc(func(d dbr.Dialect, buf dbr.Buffer) error {
+		buf.WriteString("EXISTS (SELECT 1 FROM ")
+		err := writeTable(d, buf, from)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return sqlResult(id), nil
-	}
-	if !b.onConflict {
-		return b.InsertStmt.Exec()
-	}
-	sql, err := b.interpolate()
-	if err != nil {
-		return nil, err
-	}
-	return b.dml.InsertBySql(sql).Exec()
-}
-
-// ExecContext runs the insert statement
-func (b *InsertStmt) ExecContext(ctx context.Context) (sql.Result, error) {
-	if isPostgres(b.Dialect) && len(b.InsertStmt.ReturnColumn) == 1 {
-		var id int64
-		err := b.InsertStmt.LoadContext(ctx, &id)
+		err = writeWhere(d, buf, " WHERE ", cond)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		return sqlResult(id), nil
-	}
-	if !b.onConflict {
-		return b.InsertStmt.ExecContext(ctx)
-	}
-	sql, err := b.interpolate()
-	if err != nil {
-		return nil, err
-	}
-	return b.dml.InsertBySql(sql).ExecContext(ctx)
+		buf.WriteString(")")
+		return nil
+	})
 }
 
-// OnConflict implements the ON CONFLICT clause
-func (b *InsertStmt) OnConflict(name interface{}, do dbr.Builder) *InsertStmt {
-	b.onConflict = true
-	b.name = name
-	b.do = do
-	return b
+func writeWhere(d dbr.Dialect, buf dbr.Buffer, prefix string, cond []dbr.Builder) error {
+	if len(cond) == 0 {
+		return nil
+	}
+	buf.WriteString(prefix)
+	return dbr.And(cond...).Build(d, buf)
 }
 
-// Build calls itself to build SQL.
-func (b *InsertStmt) Build(d dbr.Dialect, buf dbr.Buffer) error {
-	err := b.InsertStmt.Build(d, buf)
-	if err != nil {
-		return err
+func writeReturning(d dbr.Dialect, buf dbr.Buffer, column []string) {
+	if len(column) == 0 {
+		return
 	}
-	if b.onConflict {
-		buf.WriteString(" ON CONFLICT")
-		if b.name != "" && b.name != nil {
-			var names []string
-			name, ok := b.name.(string)
-			if ok {
-				names = []string{name}
-			} else {
-				names = b.name.([]string)
-			}
-			buf.WriteString(" (")
-			for i, n := range names {
-				if i > 0 {
-					buf.WriteString(",")
-				}
-				buf.WriteString(d.QuoteIdent(n))
-			}
-			buf.WriteString(")")
+	buf.WriteString(" RETURNING ")
+	for i, col := range column {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		if col == "*" {
+			buf.WriteString(col)
+		} else {
+			buf.WriteString(d.QuoteIdent(col))
 		}
-		buf.WriteString(" DO ")
-		b.do.Build(d, buf)
 	}
-	return nil
 }
 
-func (b *InsertStmt) interpolate() (str string, err error) {
-	buf := dbr.NewBuffer()
-	err = b.Build(b.Dialect, buf)
-	if err != nil {
-		return "", err
+// ReturningMode tells how the RETURNING clauses are handled for a session
+type ReturningMode int
+
+const (
+	// ReturningAuto is ReturningNative for PostgreSQL and ReturningEmulated
+	// for the other dialects
+	ReturningAuto ReturningMode = iota
+	// ReturningNative renders the RETURNING clauses, as supported by
+	// PostgreSQL and SQLite 3.35+. The go-sqlite3 version required by this
+	// module bundles SQLite 3.31.1, so SQLite sessions need a newer driver.
+	ReturningNative
+	// ReturningEmulated omits the RETURNING clauses. The returning columns
+	// of single row inserts are loaded by a select matching the
+	// LastInsertId against the rowid, for SQLite, or Options.IDColumn.
+	// Updates and deletes can't load their returning columns.
+	ReturningEmulated
+)
+
+// Options tunes how the statements of a session are built and run. They are
+// set by WrapOptions.
+type Options struct {
+	Returning ReturningMode
+	// Interpolate sends the statements that dbr can't run by itself, like
+	// the ones with CTEs, unions or ON CONFLICT clauses, as SQL strings with
+	// their values interpolated, instead of using bind parameters. Either
+	// way, VALUES lists are typed by the casts of their first row.
+	Interpolate bool
+	// IDColumn is the column matched against the LastInsertId by
+	// ReturningEmulated inserts, for the dialects without a rowid. Without
+	// it, they can't load their returning columns.
+	IDColumn string
+}
+
+func optionsFor(d dbr.Dialect) Options {
+	if dbrxDialect, ok := d.(dialect); ok {
+		return dbrxDialect.opts
 	}
-	return dbr.InterpolateForDialect(
-		buf.String(),
-		buf.Value(),
-		b.Dialect,
-	)
+	return Options{}
 }
 
-// UpdateStmt overcomes dbr.UpdateStmt limitations
-type UpdateStmt struct {
-	*dbr.UpdateStmt
-	withClauses withClauses
-	dml         DML
+func returningMode(d dbr.Dialect) ReturningMode {
+	if mode := optionsFor(d).Returning; mode != ReturningAuto {
+		return mode
+	}
+	if isPostgres(d) {
+		return ReturningNative
+	}
+	return ReturningEmulated
 }
 
-// Build calls itself to build SQL.
-func (b *UpdateStmt) Build(d dbr.Dialect, buf dbr.Buffer) error {
-	err := b.withClauses.write(d, buf)
-	if err != nil {
-		return err
+// lastInsertIDColumn is the column holding the LastInsertId of a row
+func lastInsertIDColumn(d dbr.Dialect) (string, error) {
+	if isSQLite(d) {
+		return "rowid", nil
+	}
+	if col := optionsFor(d).IDColumn; col != "" {
+		return d.QuoteIdent(col), nil
 	}
-	return b.UpdateStmt.Build(d, buf)
+	return "", ErrNotSupported
 }
 
-// Set updates column with value.
-func (b *UpdateStmt) Set(column string, value interface{}) *UpdateStmt {
-	b.UpdateStmt.Set(column, value)
-	return b
+// baseDialect unwraps the dbr dialect from the dbrx one
+func baseDialect(d dbr.Dialect) dbr.Dialect {
+	if dbrxDialect, ok := d.(dialect); ok {
+		return dbrxDialect.Dialect
+	}
+	return d
 }
 
-// Where adds a where condition.
-// query can be Builder or string. value is used only if query type is string.
-func (b *UpdateStmt) Where(query interface{}, value ...interface{}) *UpdateStmt {
-	b.UpdateStmt.Where(query, value)
-	return b
+func isPostgres(d dbr.Dialect) bool {
+	return baseDialect(d) == dbrdialect.PostgreSQL
 }
 
-// Exec runs the update statement
-func (b *UpdateStmt) Exec() (sql.Result, error) {
-	if len(b.withClauses) == 0 {
-		return b.UpdateStmt.Exec()
-	}
-	str, err := b.interpolateWithClause()
-	if err != nil {
-		return nil, err
-	}
-	return b.dml.UpdateBySql(str).Exec()
+func isSQLite(d dbr.Dialect) bool {
+	return baseDialect(d) == dbrdialect.SQLite3
 }
 
-// ExecContext runs the update statement
-func (b *UpdateStmt) ExecContext(ctx context.Context) (sql.Result, error) {
-	if len(b.withClauses) == 0 {
-		return b.UpdateStmt.ExecContext(ctx)
-	}
-	str, err := b.interpolateWithClause()
-	if err != nil {
-		return nil, err
-	}
-	return b.dml.UpdateBySql(str).ExecContext(ctx)
+// InsertResult is the result of InsertStmt.ExecContext. It holds the ids
+// returned by inserts with a single column and ReturningNative or, for the
+// other inserts, the LastInsertId of the last row, if the driver reports it.
+type InsertResult struct {
+	ids  []int64
+	rows int64
 }
 
-func (b *UpdateStmt) interpolateWithClause() (str string, err error) {
-	buf := dbr.NewBuffer()
-	err = b.Build(b.Dialect, buf)
+func newInsertResult(result sql.Result) (*InsertResult, error) {
+	rows, err := result.RowsAffected()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return dbr.InterpolateForDialect(
-		buf.String(),
-		buf.Value(),
-		b.Dialect,
-	)
-}
-
-// Returning specifies the returning columns for postgres.
-func (b *UpdateStmt) Returning(column ...string) *UpdateStmt {
-	if isPostgres(b.Dialect) {
-		b.UpdateStmt.Returning(column...)
+	r := &InsertResult{rows: rows}
+	// PostgreSQL drivers don't support LastInsertId
+	if id, err := result.LastInsertId(); err == nil && rows > 0 {
+		r.ids = []int64{id}
 	}
-	return b
+	return r, nil
 }
 
-func isPostgres(d dbr.Dialect) bool {
-	if dbrxDialect, ok := d.(dialect); ok {
-		return dbrxDialect.Dialect == dbrdialect.PostgreSQL
+// LastInsertId returns the last id, or 0 if no row was inserted or the id
+// is unknown
+func (r *InsertResult) LastInsertId() (int64, error) {
+	if len(r.ids) == 0 {
+		return 0, nil
 	}
-	return d == dbrdialect.PostgreSQL
+	return r.ids[len(r.ids)-1], nil
 }
 
-type sqlResult int64
-
-func (r sqlResult) LastInsertId() (int64, error) {
-	return int64(r), nil
+// RowsAffected returns the number of inserted rows, which, for upserts,
+// doesn't count the rows skipped by ON CONFLICT DO NOTHING
+func (r *InsertResult) RowsAffected() (int64, error) {
+	return r.rows, nil
 }
 
-func (r sqlResult) RowsAffected() (int64, error) {
-	return 0, nil
+// IDs returns the returned ids, in the order the database returned them.
+// Without ReturningNative, it only holds the LastInsertId.
+func (r *InsertResult) IDs() []int64 {
+	return r.ids
 }
 
 const (
 	timeFormat = "2006-01-02 15:04:05.000000 -07:00"
 )
 
-type dialect struct{ dbr.Dialect }
+type dialect struct {
+	dbr.Dialect
+	opts Options
+}
 
 func (d dialect) QuoteIdent(s string) string {
 	return d.Dialect.QuoteIdent(s)
@@ -682,12 +2241,59 @@ func (b parensBuilder) Build(d dbr.Dialect, buf dbr.Buffer) error {
 	return nil
 }
 
+// As returns builder, a query or a ValuesExpr, as a derived table named
+// alias, to be used in From and joins. The columns, if any, name the builder
+// columns. SQLite, which doesn't take the columns of a derived table, gets
+// them from a with clause.
+func As(builder dbr.Builder, alias string, column ...string) dbr.Builder {
+	return &aliasExpr{builder, alias, column}
+}
+
+type aliasExpr struct {
+	builder dbr.Builder
+	alias   string
+	column  []string
+}
+
+func (e *aliasExpr) Build(d dbr.Dialect, buf dbr.Buffer) error {
+	alias := d.QuoteIdent(e.alias)
+	column := make([]string, len(e.column))
+	for i, col := range e.column {
+		column[i] = d.QuoteIdent(col)
+	}
+	buf.WriteString("(")
+	if len(column) > 0 && isSQLite(d) {
+		buf.WriteString("WITH ")
+		buf.WriteString(alias)
+		buf.WriteString("(")
+		buf.WriteString(strings.Join(column, ", "))
+		buf.WriteString(") AS (")
+	}
+	err := e.builder.Build(d, buf)
+	if err != nil {
+		return err
+	}
+	if len(column) > 0 && isSQLite(d) {
+		buf.WriteString(") SELECT * FROM ")
+		buf.WriteString(alias)
+	}
+	buf.WriteString(") AS ")
+	buf.WriteString(alias)
+	if len(column) > 0 && !isSQLite(d) {
+		buf.WriteString(" (")
+		buf.WriteString(strings.Join(column, ", "))
+		buf.WriteString(")")
+	}
+	return nil
+}
+
 func Values(v ...interface{}) *ValuesExpr {
-	return &ValuesExpr{[][]interface{}{v}}
+	return &ValuesExpr{values: [][]interface{}{v}}
 }
 
 type ValuesExpr struct {
 	values [][]interface{}
+	types  []string
 }
 
 func (e *ValuesExpr) Values(v ...interface{}) *ValuesExpr {
@@ -698,6 +2304,21 @@ func (e *ValuesExpr) Values(v ...interface{}) *ValuesExpr {
 	return e
 }
 
+// Types sets the PostgreSQL types of the columns, overriding the ones taken
+// from the Go types of the first row. An empty type leaves its column uncast.
+func (e *ValuesExpr) Types(types ...string) *ValuesExpr {
+	e.types = types
+	return e
+}
+
+// As returns the values as a derived table named alias with the given
+// columns, to be used in From and joins.
+func (e *ValuesExpr) As(alias string, column ...string) dbr.Builder {
+	return As(e, alias, column...)
+}
+
+// Build writes the VALUES list. On PostgreSQL the placeholders of the first
+// row are cast to the column types, since they would be typed as text.
 func (e *ValuesExpr) Build(d dbr.Dialect, buf dbr.Buffer) error {
 	buf.WriteString("VALUES ")
 	for i, values := range e.values {
@@ -714,12 +2335,46 @@ func (e *ValuesExpr) Build(d dbr.Dialect, buf dbr.Buffer) error {
 			}
 			buf.WriteString(placeholder)
 			buf.WriteValue(value)
+			if i > 0 || !isPostgres(d) {
+				continue
+			}
+			typ := pgType(value)
+			if j < len(e.types) {
+				typ = e.types[j]
+			}
+			if typ != "" {
+				buf.WriteString("::")
+				buf.WriteString(typ)
+			}
 		}
 		buf.WriteString(")")
 	}
 	return nil
 }
 
+// pgType returns the PostgreSQL type of the Go value, or "" when it's unknown
+func pgType(value interface{}) string {
+	switch value.(type) {
+	case int8, int16, int32, uint8, uint16:
+		return "integer"
+	case int, int64, uint, uint32, uint64:
+		return "bigint"
+	case float32:
+		return "real"
+	case float64:
+		return "double precision"
+	case bool:
+		return "boolean"
+	case string:
+		return "text"
+	case []byte:
+		return "bytea"
+	case time.Time:
+		return "timestamptz"
+	}
+	return ""
+}
+
 func DoUpdate() *DoUpdateBuilder {
 	return &DoUpdateBuilder{
 		Value: make(map[string]interface{}),
@@ -729,23 +2384,25 @@ func DoUpdate() *DoUpdateBuilder {
 type DoUpdateBuilder struct {
 	Value     map[string]interface{}
 	WhereCond []dbr.Builder
+	// order keeps the columns in the order they were set
+	order []string
 }
 
+// Build calls itself to build SQL. The columns are written in the order they
+// were set, followed by the ones added to Value directly, sorted. Builder
+// values are written as expressions.
 func (b *DoUpdateBuilder) Build(d dbr.Dialect, buf dbr.Buffer) error {
-	buf.WriteString("UPDATE ")
-	buf.WriteString(" SET ")
-
-	i := 0
-	for col, v := range b.Value {
+	buf.WriteString("UPDATE SET ")
+	for i, col := range b.columns() {
 		if i > 0 {
 			buf.WriteString(", ")
 		}
 		buf.WriteString(d.QuoteIdent(col))
 		buf.WriteString(" = ")
-		buf.WriteString(placeholder)
-
-		buf.WriteValue(v)
-		i++
+		err := writeValue(d, buf, b.Value[col])
+		if err != nil {
+			return err
+		}
 	}
 
 	if len(b.WhereCond) > 0 {
@@ -759,11 +2416,63 @@ func (b *DoUpdateBuilder) Build(d dbr.Dialect, buf dbr.Buffer) error {
 	return nil
 }
 
+func (b *DoUpdateBuilder) columns() []string {
+	column := make([]string, 0, len(b.Value))
+	seen := make(map[string]bool, len(b.Value))
+	for _, col := range b.order {
+		if _, ok := b.Value[col]; ok && !seen[col] {
+			column = append(column, col)
+			seen[col] = true
+		}
+	}
+	var rest []string
+	for col := range b.Value {
+		if !seen[col] {
+			rest = append(rest, col)
+		}
+	}
+	sort.Strings(rest)
+	return append(column, rest...)
+}
+
+// writeValue writes a Builder as an expression, in parentheses if it is a
+// query, and any other value as a parameter
+func writeValue(d dbr.Dialect, buf dbr.Buffer, value interface{}) error {
+	switch value := value.(type) {
+	case *SelectStmt, *dbr.SelectStmt:
+		buf.WriteString("(")
+		err := value.(dbr.Builder).Build(d, buf)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(")")
+	case dbr.Builder:
+		return value.Build(d, buf)
+	default:
+		buf.WriteString(placeholder)
+		buf.WriteValue(value)
+	}
+	return nil
+}
+
+// Set updates column with expr, which is a value or a Builder, like dbr.Expr
 func (b *DoUpdateBuilder) Set(column string, expr interface{}) *DoUpdateBuilder {
 	b.Value[column] = expr
+	b.order = append(b.order, column)
 	return b
 }
 
+// SetExpr updates column with an expression, as in
+// SetExpr("count", dbr.Expr("t.count + EXCLUDED.count"))
+func (b *DoUpdateBuilder) SetExpr(column string, expr dbr.Builder) *DoUpdateBuilder {
+	return b.Set(column, expr)
+}
+
+// SetExcluded updates column with the value proposed for insertion
+func (b *DoUpdateBuilder) SetExcluded(column string) *DoUpdateBuilder {
+	return b.Set(column, dbr.Expr("EXCLUDED."+placeholder, dbr.I(column)))
+}
+
 func (b *DoUpdateBuilder) Where(query interface{}, value ...interface{}) *DoUpdateBuilder {
 	switch query := query.(type) {
 	case string:
@@ -787,11 +2496,93 @@ func Greatest(d dbr.Dialect, value ...interface{}) dbr.Builder {
 	return dbr.Expr(fmt.Sprintf("max(%v)", placeholders), value...)
 }
 
+// UnionStmt combines queries with UNION, INTERSECT and EXCEPT. It is a
+// dbr.Builder, so it can be used as a subquery or a CTE.
 type UnionStmt struct {
-	builders []dbr.Builder
-	dml      DML
-	all      bool
-	dialect  dbr.Dialect
+	builders    []dbr.Builder
+	ops         []string
+	withClauses withClauses
+	dml         DML
+	dialect     dbr.Dialect
+	order       []dbr.Builder
+	limit       int64
+	offset      int64
+}
+
+func newUnion(dml DML, d dbr.Dialect, op string, builders []dbr.Builder) *UnionStmt {
+	us := &UnionStmt{dml: dml, dialect: d, limit: -1, offset: -1}
+	return us.add(op, builders)
+}
+
+func (us *UnionStmt) add(op string, builders []dbr.Builder) *UnionStmt {
+	for _, b := range builders {
+		us.builders = append(us.builders, b)
+		us.ops = append(us.ops, op)
+	}
+	return us
+}
+
+// Union adds the rows of builders, without duplicates
+func (us *UnionStmt) Union(builders ...dbr.Builder) *UnionStmt {
+	return us.add("UNION", builders)
+}
+
+// UnionAll adds the rows of builders
+func (us *UnionStmt) UnionAll(builders ...dbr.Builder) *UnionStmt {
+	return us.add("UNION ALL", builders)
+}
+
+// Intersect keeps the rows also returned by builders, without duplicates
+func (us *UnionStmt) Intersect(builders ...dbr.Builder) *UnionStmt {
+	return us.add("INTERSECT", builders)
+}
+
+// IntersectAll keeps the rows also returned by builders. SQLite doesn't
+// support it.
+func (us *UnionStmt) IntersectAll(builders ...dbr.Builder) *UnionStmt {
+	return us.add("INTERSECT ALL", builders)
+}
+
+// Except removes the rows returned by builders, without duplicates
+func (us *UnionStmt) Except(builders ...dbr.Builder) *UnionStmt {
+	return us.add("EXCEPT", builders)
+}
+
+// ExceptAll removes the rows returned by builders. SQLite doesn't support
+// it.
+func (us *UnionStmt) ExceptAll(builders ...dbr.Builder) *UnionStmt {
+	return us.add("EXCEPT ALL", builders)
+}
+
+// OrderBy orders the combined rows
+func (us *UnionStmt) OrderBy(col string) *UnionStmt {
+	us.order = append(us.order, dbr.Expr(col))
+	return us
+}
+
+func (us *UnionStmt) OrderAsc(col string) *UnionStmt {
+	return us.OrderBy(col + " ASC")
+}
+
+func (us *UnionStmt) OrderDesc(col string) *UnionStmt {
+	return us.OrderBy(col + " DESC")
+}
+
+// Limit limits the combined rows
+func (us *UnionStmt) Limit(n uint64) *UnionStmt {
+	us.limit = int64(n)
+	return us
+}
+
+// Offset skips the first n combined rows
+func (us *UnionStmt) Offset(n uint64) *UnionStmt {
+	us.offset = int64(n)
+	return us
+}
+
+// As returns the statement as a derived table, like SelectStmt.As
+func (us *UnionStmt) As(alias string, column ...string) dbr.Builder {
+	return As(us, alias, column...)
 }
 
 func (us *UnionStmt) Load(value interface{}) (int, error) {
@@ -799,28 +2590,95 @@ func (us *UnionStmt) Load(value interface{}) (int, error) {
 }
 
 func (us *UnionStmt) LoadContext(ctx context.Context, value interface{}) (int, error) {
-	var buf = dbr.NewBuffer()
+	return loadContext(ctx, us.dml, us.dialect, us, value)
+}
+
+// RowsContext runs the union and returns its rows, which must be closed
+func (us *UnionStmt) RowsContext(ctx context.Context) (*sql.Rows, error) {
+	return queryContext(ctx, us.dml, us.dialect, us)
+}
+
+// Iter runs the union and returns a cursor over its rows
+func (us *UnionStmt) Iter(ctx context.Context) (*Cursor, error) {
+	return Iter(ctx, us)
+}
+
+// Build writes the with clauses of the statement and of its branches, which
+// can't precede a branch, then the branches. The branches wrapped by Parens,
+// and the nested unions, are parenthesized. SQLite doesn't accept
+// parenthesized branches, so they are selected from as subqueries.
+func (us *UnionStmt) Build(d dbr.Dialect, buf dbr.Buffer) error {
+	ws := us.withClauses
+	branches := make([]dbr.Builder, len(us.builders))
 	for i, b := range us.builders {
+		switch b := b.(type) {
+		case *SelectStmt:
+			if len(b.withClauses) > 0 {
+				var err error
+				ws, err = ws.merge(d, b.withClauses)
+				if err != nil {
+					return err
+				}
+				c := *b
+				c.withClauses = nil
+				branches[i] = &c
+				continue
+			}
+		case *UnionStmt:
+			branches[i] = parensBuilder{b}
+			continue
+		}
+		branches[i] = b
+	}
+	err := ws.write(d, buf)
+	if err != nil {
+		return err
+	}
+
+	for i, b := range branches {
 		if i > 0 {
-			buf.WriteString(" UNION ")
-			if us.all {
-				buf.WriteString("ALL ")
+			op := us.ops[i]
+			if isSQLite(d) && strings.HasSuffix(op, " ALL") && op != "UNION ALL" {
+				return ErrNotSupported
 			}
+			buf.WriteString(" ")
+			buf.WriteString(op)
+			buf.WriteString(" ")
 		}
-		err := b.Build(us.dialect, buf)
+		if p, ok := b.(parensBuilder); ok && isSQLite(d) {
+			buf.WriteString("SELECT * FROM ")
+			b = p
+		}
+		err = b.Build(d, buf)
 		if err != nil {
-			return 0, err
+			return err
 		}
 	}
-	str, err := dbr.InterpolateForDialect(
-		buf.String(),
-		buf.Value(),
-		us.dialect,
-	)
-	if err != nil {
-		return 0, err
+
+	if len(us.order) > 0 {
+		buf.WriteString(" ORDER BY ")
+		for i, order := range us.order {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			err = order.Build(d, buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if us.limit >= 0 {
+		buf.WriteString(" LIMIT ")
+		buf.WriteString(strconv.FormatInt(us.limit, 10))
+	} else if us.offset >= 0 && isSQLite(d) {
+		// SQLite requires a LIMIT before an OFFSET
+		buf.WriteString(" LIMIT -1")
 	}
-	return us.dml.SelectBySql(str).LoadContext(ctx, value)
+	if us.offset >= 0 {
+		buf.WriteString(" OFFSET ")
+		buf.WriteString(strconv.FormatInt(us.offset, 10))
+	}
+	return nil
 }
 
 type MultipleEventReceiver []dbr.EventReceiver
@@ -882,7 +2740,6 @@ func (ers MultipleEventReceiver) TimingKv(eventName string, nanoseconds int64, k
 }
 
 func (ers MultipleEventReceiver) Add(fn func()) {
-	type funcAdder interface{ Add(func()) }
 	var added bool
 	for _, er := range ers {
 		if er == nil {
@@ -1,16 +1,44 @@
 package dbrx
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gocraft/dbr/v2"
 	dbrdialect "github.com/gocraft/dbr/v2/dialect"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// postgres returns a DML that builds statements for PostgreSQL, without a
+// database connection
+func postgres() DML {
+	return Wrap(&dbr.Session{
+		Connection: &dbr.Connection{
+			Dialect:       dbrdialect.PostgreSQL,
+			EventReceiver: &dbr.NullEventReceiver{},
+		},
+		EventReceiver: &dbr.NullEventReceiver{},
+	})
+}
+
+// postgresTx returns a PostgreSQL transaction that only builds statements
+func postgresTx() TX {
+	return outerTransaction{
+		Tx: &dbr.Tx{
+			Dialect:       dbrdialect.PostgreSQL,
+			EventReceiver: &dbr.NullEventReceiver{},
+		},
+		state: &txState{},
+	}
+}
+
 func TestRunInTransaction(t *testing.T) {
 	cases := []struct {
 		name   string
@@ -60,6 +88,25 @@ func TestRunInTransaction(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			"insert rows, one of them in a failed inner transaction, must commit the others",
+			func(tx TX) error {
+				tx.InsertInto("t").Columns("s").Values("a").Exec()
+				RunInTransaction(tx, func(innertx TX) error {
+					innertx.InsertInto("t").Columns("s").Values("b").Exec()
+					return fmt.Errorf("err")
+				})
+				innertx, _ := tx.Begin()
+				innertx.InsertInto("t").Columns("s").Values("c").Exec()
+				innertx.Commit()
+				return nil
+			},
+			func(dml DML) bool {
+				ss, err := dml.Select("s").From("t").ReturnStrings()
+				return err == nil && reflect.DeepEqual([]string{"a", "c"}, ss)
+			},
+			nil,
+		},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -81,6 +128,143 @@ func TestRunInTransaction(t *testing.T) {
 	}
 }
 
+func TestRunInTransactionContext(t *testing.T) {
+	// the cancelled transaction may discard its connection, so the database
+	// must outlive it
+	conn, err := dbr.Open("sqlite3", filepath.Join(t.TempDir(), "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	dml := Wrap(sess)
+	sess.Exec("create table t(id integer primary key, s varchar);")
+	ctx, cancel := context.WithCancel(context.Background())
+	err = RunInTransactionContext(ctx, dml, nil, func(ctx context.Context, tx TX) error {
+		tx.InsertInto("t").Columns("s").Values("a").ExecContext(ctx)
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	ss, err := dml.Select("s").From("t").ReturnStrings()
+	if err != nil || len(ss) != 0 {
+		t.Errorf("expected no rows, got %v, %v", ss, err)
+	}
+}
+
+func TestRunInTransactionWithRetry(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(&AfterCommitEventReceiver{})
+	dml := Wrap(sess)
+	sess.Exec("create table t(id integer primary key, s varchar);")
+	errConflict := errors.New("conflict")
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		IsRetryable: func(err error) bool { return err == errConflict },
+	}
+	var attempts, hooks int
+	err = RunInTransactionWithRetry(context.Background(), dml, nil, policy, func(ctx context.Context, tx TX) error {
+		attempts++
+		tx.InsertInto("t").Columns("s").Values("a").ExecContext(ctx)
+		tx.RunAfterCommit(func() { hooks++ })
+		if attempts < 3 {
+			return errConflict
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || hooks != 1 {
+		t.Errorf("expected 3 attempts and 1 hook, got %v and %v", attempts, hooks)
+	}
+	ss, err := dml.Select("s").From("t").ReturnStrings()
+	if err != nil || !reflect.DeepEqual([]string{"a"}, ss) {
+		t.Errorf("expected [a], got %v, %v", ss, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cases := []struct {
+		name     string
+		policy   RetryPolicy
+		attempt  int
+		min, max time.Duration
+	}{
+		{"zero", RetryPolicy{MaxAttempts: 3, MaxBackoff: time.Second}, 2, 0, 0},
+		{"first", RetryPolicy{Backoff: 10 * time.Millisecond}, 1, 5 * time.Millisecond, 10 * time.Millisecond},
+		{"doubled", RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: time.Second}, 3, 20 * time.Millisecond, 40 * time.Millisecond},
+		{"max", RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: time.Second}, 10, 500 * time.Millisecond, time.Second},
+		{"overflow", RetryPolicy{Backoff: time.Hour, MaxBackoff: time.Second}, 40, 500 * time.Millisecond, time.Second},
+	}
+	for _, c := range cases {
+		d := c.policy.backoff(c.attempt)
+		if d < c.min || d > c.max {
+			t.Errorf("%v: expected between %v and %v, got %v", c.name, c.min, c.max, d)
+		}
+	}
+}
+
+func TestRunInTransactionCommitError(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMaxOpenConns(1)
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		pragma foreign_keys = on;
+		create table p(id integer primary key);
+		create table c(id integer primary key,
+			p integer references p(id) deferrable initially deferred);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RunInTransaction(Wrap(sess), func(tx TX) error {
+		_, err := tx.InsertInto("c").Columns("p").Values(1).Exec()
+		return err
+	})
+	if err == nil {
+		t.Error("expected the commit error")
+	}
+}
+
+func TestRunInTransactionPanic(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	dml := Wrap(sess)
+	sess.Exec("create table t(id integer primary key, s varchar);")
+	insertAndPanic := func(ctx context.Context, tx TX) error {
+		tx.InsertInto("t").Columns("s").Values("a").Exec()
+		panic("boom")
+	}
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Errorf("expected the panic to propagate, got %v", p)
+			}
+		}()
+		RunInTransactionContext(context.Background(), dml, nil, insertAndPanic)
+	}()
+	err = RunInTransactionContext(context.Background(), dml, nil, RecoverPanic(insertAndPanic))
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+		t.Errorf("expected a PanicError, got %v", err)
+	}
+	ss, err := dml.Select("s").From("t").ReturnStrings()
+	if err != nil || len(ss) != 0 {
+		t.Errorf("expected no rows, got %v, %v", ss, err)
+	}
+}
+
 func TestReturning(t *testing.T) {
 	cases := []struct {
 		name  string
@@ -124,6 +308,139 @@ func TestReturning(t *testing.T) {
 
 }
 
+func TestReturningEmulated(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	dml := Wrap(sess)
+	sess.Exec("create table t(id integer primary key, s varchar, n integer default 7);")
+	var row struct {
+		ID int64
+		S  string
+		N  int
+	}
+	n, err := dml.InsertInto("t").
+		Columns("s").
+		Values("v").
+		Returning("id", "s", "n").
+		Load(&row)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || row.ID != 1 || row.S != "v" || row.N != 7 {
+		t.Errorf("expected the inserted row, got %v", row)
+	}
+	_, err = dml.InsertInto("t").
+		Columns("s").
+		Values("v").
+		Values("w").
+		Returning("id").
+		Load(&row)
+	if err != ErrNotSupported {
+		t.Errorf("expected %v, got %v", ErrNotSupported, err)
+	}
+	_, err = dml.Update("t").Set("s", "w").Returning("id").Load(&row)
+	if err != ErrNotSupported {
+		t.Errorf("expected %v, got %v", ErrNotSupported, err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	native := WrapOptions(conn.NewSession(nil), Options{Returning: ReturningNative})
+	emulated := Wrap(conn.NewSession(nil))
+	build := func(b dbr.Builder) string {
+		buf := dbr.NewBuffer()
+		if err := b.Build(b.(*InsertStmt).Dialect, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	expected := `INSERT INTO "t" ("c") VALUES (?) RETURNING "id"`
+	if sql := build(native.InsertInto("t").Columns("c").Values(1).Returning("id")); sql != expected {
+		t.Errorf("expected %v, got %v", expected, sql)
+	}
+	expected = `INSERT INTO "t" ("c") VALUES (?)`
+	if sql := build(emulated.InsertInto("t").Columns("c").Values(1).Returning("id")); sql != expected {
+		t.Errorf("expected %v, got %v", expected, sql)
+	}
+
+	if _, err := lastInsertIDColumn(dialect{Dialect: dbrdialect.PostgreSQL}); err != ErrNotSupported {
+		t.Errorf("expected %v, got %v", ErrNotSupported, err)
+	}
+	col, err := lastInsertIDColumn(dialect{dbrdialect.PostgreSQL, Options{IDColumn: "key"}})
+	if err != nil || col != `"key"` {
+		t.Errorf("expected the key column, got %v, %v", col, err)
+	}
+}
+
+func TestInsertResult(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the batches run in a transaction, which must see the same database
+	conn.SetMaxOpenConns(1)
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`create table t(id integer primary key, code varchar unique)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dml := Wrap(sess)
+	check := func(name string, res sql.Result, rows int64, ids []int64) {
+		t.Helper()
+		result, ok := res.(*InsertResult)
+		if !ok {
+			t.Fatalf("%v: expected an *InsertResult, got %T", name, res)
+		}
+		n, _ := result.RowsAffected()
+		id, _ := result.LastInsertId()
+		if n != rows || !reflect.DeepEqual(ids, result.IDs()) || id != ids[len(ids)-1] {
+			t.Errorf("%v: expected %v rows and ids %v, got %v rows, ids %v, last %v", name, rows, ids, n, result.IDs(), id)
+		}
+	}
+
+	res, err := dml.InsertInto("t").Columns("code").Values("a").Values("b").Returning("id").Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("multiple rows", res, 2, []int64{2})
+
+	res, err = dml.InsertInto("t").Columns("code").Values("x").Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("plain", res, 1, []int64{3})
+
+	res, err = dml.InsertInto("t").Columns("code").Values("a").Values("c").
+		OnConflict("code", nil).
+		Returning("id").
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("do nothing", res, 1, []int64{4})
+
+	stmt := dml.InsertInto("t").Columns("code").Returning("id")
+	for i := 0; i < 2000; i++ {
+		stmt.Values(fmt.Sprint("batch", i))
+	}
+	if n := len(stmt.batches()); n != 3 {
+		t.Errorf("expected 3 batches, got %v", n)
+	}
+	res, err = stmt.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last id of each batch
+	check("batches", res, 2000, []int64{1003, 2002, 2004})
+}
+
 func TestWith(t *testing.T) {
 	type builder interface {
 		Build(d dbr.Dialect, buf dbr.Buffer) error
@@ -162,6 +479,25 @@ func TestWith(t *testing.T) {
 			},
 			map[int]string{1: "v_1", 2: "v_2"},
 		},
+		{
+			"With before Delete",
+			`create table t (id integer primary key, value varchar);
+			 insert into t(value) values ('v1'),('v2');`,
+			func(dml DML) builder {
+				return dml.
+					With("v(id)", Values(1)).
+					DeleteFrom("t").
+					Where("t.id in ?", dml.Select("id").From("v"))
+			},
+			`WITH v(id) AS (VALUES (1))
+			 DELETE FROM "t" WHERE (t.id in (SELECT id FROM v))`,
+			func(dml DML) (interface{}, error) {
+				m := make(map[int]string)
+				_, err := dml.Select("id", "value").From("t").Load(&m)
+				return m, err
+			},
+			map[int]string{2: "v2"},
+		},
 		{
 			"With before Select",
 			`create table t (id integer primary key, value varchar);
@@ -256,7 +592,7 @@ func TestWith(t *testing.T) {
 				t.Error(err)
 			}
 			switch stmt := builder.(type) {
-			case *UpdateStmt:
+			case interface{ Exec() (sql.Result, error) }:
 				if c.data != nil && c.assert != nil {
 					_, err = stmt.Exec()
 					if err != nil {
@@ -286,6 +622,205 @@ func TestWith(t *testing.T) {
 	}
 }
 
+func TestWithScope(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`create table t(id integer primary key)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := func(b dbr.Builder) string {
+		buf := dbr.NewBuffer()
+		if err := b.Build(dbrdialect.SQLite3, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	for _, dml := range []DML{Wrap(sess), postgresTx()} {
+		v := dml.With("v", dml.Select("id").From("t"))
+		w := v.With("w", dml.Select("id").From("v"))
+		v.InsertInto("t").Columns("id").Values(1)
+		if sql := build(dml.DeleteFrom("t")); sql != `DELETE FROM "t"` {
+			t.Errorf("the with clause leaked: %v", sql)
+		}
+		if sql := build(v.Select("*").From("v")); sql != `WITH v AS (SELECT id FROM "t") SELECT * FROM "v"` {
+			t.Errorf("unexpected %v", sql)
+		}
+		if sql := build(v.Update("t").Set("id", 2)); sql != `WITH v AS (SELECT id FROM "t") UPDATE "t" SET "id" = ?` {
+			t.Errorf("unexpected %v", sql)
+		}
+		expected := `WITH v AS (SELECT id FROM "t"), w AS (SELECT id FROM "v") SELECT * FROM "w"`
+		if sql := build(w.Select("*").From("w")); sql != expected {
+			t.Errorf("unexpected %v", sql)
+		}
+	}
+}
+
+func TestWithScopeTX(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`create table t(id integer primary key)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errConflict := errors.New("conflict")
+	err = RunInTransaction(Wrap(sess), func(tx TX) error {
+		scoped := tx.With("v", tx.Select("id").From("t"))
+		if _, ok := asTX(scoped); !ok {
+			t.Error("expected the scope of a transaction to be a transaction")
+		}
+		buf := dbr.NewBuffer()
+		err := scoped.Select("*").From("v").ForUpdate().Build(dbrdialect.PostgreSQL, buf)
+		expected := `WITH v AS (SELECT id FROM "t") SELECT * FROM "v" FOR UPDATE`
+		if err != nil || buf.String() != expected {
+			t.Errorf("expected %v, got %v, %v", expected, buf.String(), err)
+		}
+
+		// the enclosing transaction owner retries, not the scope
+		attempts := 0
+		err = RunInTransactionWithRetry(context.Background(), scoped, nil, RetryPolicy{
+			MaxAttempts: 3,
+			IsRetryable: func(err error) bool { return err == errConflict },
+		}, func(ctx context.Context, tx TX) error {
+			attempts++
+			return errConflict
+		})
+		if err != errConflict || attempts != 1 {
+			t.Errorf("expected a single attempt, got %v, %v", attempts, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectWith(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dml := Wrap(conn.NewSession(nil))
+	with := func() *SelectStmt {
+		return dml.
+			With("v(id,value)", Values(1, "v1").Values(2, "v2")).
+			Select("id", "value").
+			From("v").
+			Where("id > ?", 1)
+	}
+	id, err := dml.With("v(id)", Values(7)).Select("id").From("v").ReturnInt64()
+	if err != nil || id != 7 {
+		t.Errorf("ReturnInt64: expected 7, got %v, %v", id, err)
+	}
+	var one struct {
+		ID    int
+		Value string
+	}
+	err = with().LoadOne(&one)
+	if err != nil || one.ID != 2 || one.Value != "v2" {
+		t.Errorf("LoadOne: got %v, %v", one, err)
+	}
+	rows, err := with().Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var id int
+		var value string
+		if err := rows.Scan(&id, &value); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, value)
+	}
+	if !reflect.DeepEqual([]string{"v2"}, values) {
+		t.Errorf("Rows: got %v", values)
+	}
+}
+
+func TestWithRecursive(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table org(id integer primary key, parent integer);
+		insert into org values (1, null), (2, 1), (3, 2), (4, 1), (5, null);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dml := Wrap(sess)
+	type node struct {
+		ID    int64
+		Depth int64
+	}
+	var nodes []node
+	_, err = dml.
+		WithOptions("tree", dbr.Expr(`
+			SELECT id, 0 FROM org WHERE id = ?
+			UNION ALL
+			SELECT org.id, tree.depth + 1 FROM org JOIN tree ON org.parent = tree.id`, 1),
+			CTEOptions{Recursive: true, Columns: []string{"id", "depth"}, Materialization: Materialized}).
+		Select("id", "depth").
+		From("tree").
+		OrderAsc("id").
+		Load(&nodes)
+	expected := []node{{1, 0}, {2, 1}, {3, 2}, {4, 1}}
+	if err != nil || !reflect.DeepEqual(expected, nodes) {
+		t.Errorf("expected %v, got %v, %v", expected, nodes, err)
+	}
+}
+
+func TestInsertSelect(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(id integer primary key, s varchar);
+		create table archive(id integer primary key, s varchar);
+		insert into t values (1, 'a'), (2, 'b');
+		insert into archive values (1, 'old');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dml := Wrap(sess)
+	_, err = dml.
+		With("moved", dml.Select("id", "s").From("t")).
+		InsertInto("archive").
+		Columns("id", "s").
+		Select(dml.Select("id", "s").From("moved")).
+		OnConflict("id", DoUpdate().SetExcluded("s")).
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dml.
+		InsertInto("archive").
+		Columns("id", "s").
+		Select(dml.With("v(id, s)", Values(3, "c")).Select("id", "s").From("v")).
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	_, err = dml.Select("s").From("archive").OrderAsc("id").Load(&values)
+	if err != nil || !reflect.DeepEqual([]string{"a", "b", "c"}, values) {
+		t.Errorf("got %v, %v", values, err)
+	}
+}
+
 func TestBuild(t *testing.T) {
 	conn, err := dbr.Open("sqlite3", ":memory:", nil)
 	if err != nil {
@@ -306,6 +841,11 @@ func TestBuild(t *testing.T) {
 				OnConflict("c", dml.Update("t").Set("t", "v")),
 			`INSERT INTO "t" ("c") VALUES (?) ON CONFLICT ("c") DO UPDATE "t" SET "t" = ?`,
 		},
+		{
+			"update returning, emulated",
+			dml.Update("t").Set("c", "v").Returning("id"),
+			`UPDATE "t" SET "c" = ?`,
+		},
 		{
 			"on conflict do nothing",
 			dml.
@@ -315,6 +855,36 @@ func TestBuild(t *testing.T) {
 				OnConflict("", dbr.Expr("nothing")),
 			`INSERT INTO "t" ("c") VALUES (?) ON CONFLICT DO nothing`,
 		},
+		{
+			"group by",
+			dml.
+				Select("c", "count(*)").
+				From("t").
+				GroupBy("c").
+				Having("count(*) > ?", 1).
+				Limit(2).
+				Offset(1),
+			`SELECT c, count(*) FROM "t" GROUP BY c HAVING (count(*) > ?) LIMIT 2 OFFSET 1`,
+		},
+		{
+			"update set map",
+			dml.
+				Update("t").
+				Set("c", 1).
+				SetMap(map[string]interface{}{"b": 2, "a": 3}).
+				Where("id = ? AND org = ?", 1, 2),
+			`UPDATE "t" SET "a" = ?, "b" = ?, "c" = ? WHERE (id = ? AND org = ?)`,
+		},
+		{
+			"update limit",
+			dml.
+				Update("t").
+				Increment("n", 1).
+				SetExpr("s", "upper(s)").
+				Where("n > ?", 0).
+				Limit(2),
+			`UPDATE "t" SET "n" = ?, "s" = ? WHERE "t".rowid IN (SELECT "t".rowid FROM "t" WHERE (n > ?) LIMIT 2)`,
+		},
 	}
 	for _, c := range cases {
 		buf := dbr.NewBuffer()
@@ -328,6 +898,194 @@ func TestBuild(t *testing.T) {
 	}
 }
 
+func TestBuildPostgres(t *testing.T) {
+	dml := postgres()
+	cases := []struct {
+		name   string
+		input  dbr.Builder
+		output string
+	}{
+		{
+			"upsert returning",
+			dml.
+				InsertInto("t").
+				Columns("c").
+				Values("v").
+				OnConflict("c", dbr.Expr("nothing")).
+				Returning("id", "c"),
+			`INSERT INTO "t" ("c") VALUES (?) ON CONFLICT ("c") DO nothing RETURNING "id","c"`,
+		},
+		{
+			"upsert do nothing returning id",
+			dml.
+				InsertInto("t").
+				Columns("c").
+				Values("a").
+				Values("b").
+				OnConflict("c", nil).
+				Returning("id"),
+			`INSERT INTO "t" ("c") VALUES (?), (?) ON CONFLICT ("c") DO NOTHING RETURNING "id"`,
+		},
+		{
+			"delete returning",
+			dml.DeleteFrom("t").Where("c = ?", "v").Returning("id"),
+			`DELETE FROM "t" WHERE (c = ?) RETURNING "id"`,
+		},
+		{
+			"distinct on",
+			dml.Select("*").From("t").DistinctOn("a").OrderAsc("a").OrderDesc("b"),
+			`SELECT DISTINCT ON (a) * FROM "t" ORDER BY a ASC, b DESC`,
+		},
+		{
+			"window",
+			dml.
+				Select("id", "rank() OVER w").
+				From("t").
+				Window("w", "PARTITION BY dept ORDER BY salary DESC").
+				OrderAsc("id").
+				Limit(10).
+				Offset(5),
+			`SELECT id, rank() OVER w FROM "t" WINDOW "w" AS (PARTITION BY dept ORDER BY salary DESC) ORDER BY id ASC LIMIT 10 OFFSET 5`,
+		},
+		{
+			"cross and lateral joins",
+			dml.
+				Select("*").
+				From("a").
+				CrossJoin("b").
+				LateralJoin(dml.Select("*").From("c").Where("c.a_id = a.id").As("c"), "true"),
+			`SELECT * FROM "a" CROSS JOIN "b" JOIN LATERAL (SELECT * FROM "c" WHERE (c.a_id = a.id)) AS "c" ON true`,
+		},
+		{
+			"for update skip locked",
+			postgresTx().
+				Select("*").
+				From("jobs").
+				Where("done = ?", false).
+				OrderAsc("id").
+				Limit(1).
+				ForUpdate().
+				SkipLocked(),
+			`SELECT * FROM "jobs" WHERE (done = ?) ORDER BY id ASC LIMIT 1 FOR UPDATE SKIP LOCKED`,
+		},
+		{
+			"for share of",
+			postgresTx().
+				Select("*").
+				From("a").
+				Join("b", "a.id = b.a_id").
+				ForShare().
+				Of("a", "b").
+				NoWait(),
+			`SELECT * FROM "a" JOIN "b" ON a.id = b.a_id FOR SHARE OF "a", "b" NOWAIT`,
+		},
+		{
+			"update from",
+			dml.
+				Update("t").
+				Set("c", dbr.I("s.c")).
+				From("s").
+				Where("t.id = s.t_id").
+				Returning("id"),
+			`UPDATE "t" SET "c" = ? FROM "s" WHERE (t.id = s.t_id) RETURNING "id"`,
+		},
+		{
+			"update from limit",
+			dml.
+				Update("t").
+				Set("c", dbr.I("s.c")).
+				From("s").
+				Where("t.id = s.t_id").
+				Limit(10),
+			`UPDATE "t" SET "c" = ? FROM "s" WHERE "t".ctid IN (SELECT "t".ctid FROM "t" WHERE (EXISTS (SELECT 1 FROM "s" WHERE (t.id = s.t_id))) LIMIT 10) AND (t.id = s.t_id)`,
+		},
+		{
+			"with options",
+			dml.
+				WithOptions("v", dml.Select("*").From("t"), CTEOptions{
+					Columns:         []string{"a"},
+					Materialization: NotMaterialized,
+				}).
+				WithRecursive("r", dbr.Expr("SELECT 1 UNION ALL SELECT n + 1 FROM r"), "n").
+				Select("a").
+				From("v"),
+			`WITH RECURSIVE v("a") AS NOT MATERIALIZED (SELECT * FROM "t"), r("n") AS (SELECT 1 UNION ALL SELECT n + 1 FROM r) SELECT a FROM "v"`,
+		},
+		{
+			"data-modifying with",
+			dml.
+				With("moved", dml.DeleteFrom("t").Where("done").Returning("*")).
+				InsertInto("archive").
+				Select(dml.Select("*").From("moved")).
+				Returning("id"),
+			`WITH moved AS (DELETE FROM "t" WHERE (done) RETURNING *) INSERT INTO "archive" SELECT * FROM "moved" RETURNING "id"`,
+		},
+		{
+			"update from values",
+			dml.
+				Update("t").
+				Set("c", dbr.I("v.c")).
+				From(Values(1, "a").Values(2, "b").As("v", "id", "c")).
+				Where("t.id = v.id"),
+			`UPDATE "t" SET "c" = ? FROM (VALUES (?::bigint,?::text),(?,?)) AS "v" ("id", "c") WHERE (t.id = v.id)`,
+		},
+		{
+			"delete using",
+			dml.
+				DeleteFrom("t").
+				Using(dml.Select("id").From("s").Where("expired").As("s")).
+				Where("t.id = s.id").
+				Returning("id"),
+			`DELETE FROM "t" USING (SELECT id FROM "s" WHERE (expired)) AS "s" WHERE (t.id = s.id) RETURNING "id"`,
+		},
+		{
+			"set operations",
+			dml.Union(dml.Select("id").From("a")).
+				IntersectAll(dml.Select("id").From("b")).
+				Except(Parens(dml.Select("id").From("c").OrderDesc("id").Limit(1))).
+				OrderAsc("id").
+				Limit(10).
+				Offset(5),
+			`SELECT id FROM "a" INTERSECT ALL SELECT id FROM "b" EXCEPT (SELECT id FROM "c" ORDER BY id DESC LIMIT 1) ORDER BY id ASC LIMIT 10 OFFSET 5`,
+		},
+		{
+			"nested union",
+			dml.Union(
+				dml.Select("id").From("a"),
+				dml.UnionAll(dml.Select("id").From("b"), dml.Select("id").From("c")),
+			),
+			`SELECT id FROM "a" UNION (SELECT id FROM "b" UNION ALL SELECT id FROM "c")`,
+		},
+		{
+			"union branches with",
+			dml.With("v", dml.Select("id").From("t")).
+				With("w", dml.Select("id").From("u")).
+				UnionAll(
+					dml.With("v", dml.Select("id").From("t")).Select("id").From("v"),
+					dml.With("w", dml.Select("id").From("u")).Select("id").From("w"),
+				),
+			`WITH v AS (SELECT id FROM "t"), w AS (SELECT id FROM "u") SELECT id FROM "v" UNION ALL SELECT id FROM "w"`,
+		},
+		{
+			"union cte",
+			dml.With("u", dml.UnionAll(dml.Select("id").From("a"), dml.Select("id").From("b"))).
+				Select("*").
+				From("u"),
+			`WITH u AS (SELECT id FROM "a" UNION ALL SELECT id FROM "b") SELECT * FROM "u"`,
+		},
+	}
+	for _, c := range cases {
+		buf := dbr.NewBuffer()
+		err := c.input.Build(dbrdialect.PostgreSQL, buf)
+		if err != nil {
+			t.Error(err)
+		}
+		if c.output != buf.String() {
+			t.Errorf("%v: expected\n%v,\ngot\n%v.", c.name, c.output, buf.String())
+		}
+	}
+}
+
 func TestGreatest(t *testing.T) {
 	conn, err := dbr.Open("sqlite3", ":memory:", nil)
 	if err != nil {
@@ -373,27 +1131,83 @@ func TestUnion(t *testing.T) {
 		panic(err)
 	}
 	dml := Wrap(sess)
+	v := dml.With("v", dml.Select("*").From("t1"))
 	cases := []struct {
 		name  string
-		input *UnionStmt
+		input dbr.Builder
+		rows  int
 	}{
 		{
 			"two selects",
 			dml.Union(
 				dml.Select("*").From("t1").Where("id = ?", 1),
 				dml.Select("*").From("t2").Where("id = ?", 2)),
+			2,
+		},
+		{
+			"union all",
+			dml.UnionAll(dml.Select("*").From("t1"), dml.Select("*").From("t1")),
+			2,
+		},
+		{
+			"intersect",
+			dml.Union(dml.Select("*").From("t1")).Intersect(dml.Select("*").From("t2")),
+			0,
+		},
+		{
+			"except",
+			dml.UnionAll(dml.Select("*").From("t1"), dml.Select("*").From("t2")).
+				Except(dml.Select("*").From("t2")),
+			1,
+		},
+		{
+			"parens, order and offset",
+			dml.UnionAll(
+				Parens(dml.Select("*").From("t1").OrderDesc("id").Limit(1)),
+				dml.Select("*").From("t2")).
+				OrderDesc("id").
+				Offset(1),
+			1,
+		},
+		{
+			"branches with",
+			v.Union(v.Select("*").From("v"), dml.Select("*").From("t2")),
+			2,
+		},
+		{
+			"branches with the same clause",
+			v.Union(v.Select("*").From("v"), dml.With("v", dml.Select("*").From("t1")).Select("*").From("v")),
+			1,
+		},
+		{
+			"subquery",
+			dml.Select("*").From(
+				dml.Union(dml.Select("*").From("t1"), dml.Select("*").From("t2")).As("u"),
+			).Where("id > ?", 1),
+			1,
 		},
 	}
 	for _, c := range cases {
 		var r []struct{ ID int }
-		_, err := c.input.Load(&r)
+		_, err := c.input.(Loader).LoadContext(context.Background(), &r)
 		if err != nil {
-			t.Error(err)
+			t.Errorf("%v: %v", c.name, err)
 		}
-		if len(r) != 2 {
-			t.Errorf("expected\ntwo rows,\ngot\n%v.", r)
+		if len(r) != c.rows {
+			t.Errorf("%v: expected\n%v rows,\ngot\n%v.", c.name, c.rows, r)
 		}
 	}
+
+	_, err = dml.Union(dml.Select("*").From("t1")).IntersectAll(dml.Select("*").From("t2")).Load(&[]int{})
+	if err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+
+	w := dml.With("v", dml.Select("*").From("t2"))
+	_, err = v.Union(v.Select("*").From("v"), w.Select("*").From("v")).Load(&[]int{})
+	if err != ErrWithConflict {
+		t.Errorf("expected ErrWithConflict, got %v", err)
+	}
 }
 
 func TestRunAfterCommit(t *testing.T) {
@@ -415,4 +1229,895 @@ func TestRunAfterCommit(t *testing.T) {
 	if !ok || !ok2 {
 		t.Errorf("not ok")
 	}
+	ok, ok2 = false, false
+	err = RunInTransaction(dml, func(tx TX) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || ok2 {
+		t.Errorf("functions must run only once")
+	}
+}
+
+func TestTransactionHooks(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(&AfterCommitEventReceiver{})
+	dml := Wrap(sess)
+	sess.Exec("create table t(id integer primary key, s varchar);")
+	var calls []string
+	record := func(call string) func() {
+		return func() { calls = append(calls, call) }
+	}
+	errVeto := errors.New("veto")
+	cases := []struct {
+		name  string
+		input func(tx TX) error
+		calls []string
+		err   error
+	}{
+		{
+			"commit",
+			func(tx TX) error {
+				tx.RunAfterCommit(record("commit"))
+				tx.RunAfterRollback(record("rollback"))
+				return tx.RunBeforeCommit(func() error {
+					record("before")()
+					return nil
+				})
+			},
+			[]string{"before", "commit"},
+			nil,
+		},
+		{
+			"rollback",
+			func(tx TX) error {
+				tx.RunAfterCommit(record("commit"))
+				tx.RunAfterRollback(record("rollback"))
+				return errVeto
+			},
+			[]string{"rollback"},
+			errVeto,
+		},
+		{
+			"veto",
+			func(tx TX) error {
+				tx.InsertInto("t").Columns("s").Values("a").Exec()
+				tx.RunAfterCommit(record("commit"))
+				tx.RunAfterRollback(record("rollback"))
+				return tx.RunBeforeCommit(func() error { return errVeto })
+			},
+			[]string{"rollback"},
+			errVeto,
+		},
+		{
+			"inner rollback",
+			func(tx TX) error {
+				tx.RunAfterCommit(record("outer commit"))
+				RunInTransaction(tx, func(innertx TX) error {
+					innertx.RunAfterCommit(record("inner commit"))
+					innertx.RunAfterRollback(record("inner rollback"))
+					return errVeto
+				})
+				return nil
+			},
+			[]string{"inner rollback", "outer commit"},
+			nil,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			calls = nil
+			err := RunInTransaction(dml, c.input)
+			if err != c.err {
+				t.Errorf("expected %v, got %v", c.err, err)
+			}
+			if !reflect.DeepEqual(c.calls, calls) {
+				t.Errorf("expected %v, got %v", c.calls, calls)
+			}
+		})
+	}
+	ss, err := dml.Select("s").From("t").ReturnStrings()
+	if err != nil || len(ss) != 0 {
+		t.Errorf("expected the vetoed insert to be rolled back, got %v, %v", ss, err)
+	}
+}
+
+func TestQueryHelpers(t *testing.T) {
+	// the session is queried while the transaction holds a connection, so
+	// both must see the same database
+	conn, err := dbr.Open("sqlite3", filepath.Join(t.TempDir(), "db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(id integer primary key, s varchar);
+		insert into t(s) values ('a'), ('b');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		ID int64
+		S  string
+	}
+	ctx := context.Background()
+	err = RunInTransaction(Wrap(sess), func(tx TX) error {
+		for _, dml := range []DML{Wrap(sess), tx} {
+			rows, err := All[row](ctx, dml.Select("id", "s").From("t").OrderAsc("id"))
+			if err != nil || !reflect.DeepEqual([]row{{1, "a"}, {2, "b"}}, rows) {
+				t.Errorf("All: got %v, %v", rows, err)
+			}
+			r, err := One[row](ctx, dml.
+				With("v", dml.Select("id", "s").From("t")).
+				Select("id", "s").
+				From("v").
+				Where("id = ?", 2))
+			if err != nil || r != (row{2, "b"}) {
+				t.Errorf("One: got %v, %v", r, err)
+			}
+			_, err = One[row](ctx, dml.Select("id", "s").From("t").Where("id = ?", 3))
+			if err != ErrNotFound {
+				t.Errorf("One: expected %v, got %v", ErrNotFound, err)
+			}
+			p, err := Maybe[row](ctx, dml.SelectBySql("select id, s from t where id = ?", 3))
+			if err != nil || p != nil {
+				t.Errorf("Maybe: got %v, %v", p, err)
+			}
+			n, err := Scalar[int64](ctx, dml.Union(
+				dml.Select("count(*)").From("t"),
+				dml.Select("count(*)").From("t")))
+			if err != nil || n != 2 {
+				t.Errorf("Scalar: got %v, %v", n, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetMaxOpenConns(1)
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(id integer primary key, s varchar, created_at varchar);
+		insert into t(s) values ('a'), ('b'), ('c');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type base struct {
+		ID int64
+	}
+	type row struct {
+		base
+		Value   string `db:"s"`
+		Ignored string `db:"-"`
+	}
+	dml := Wrap(sess)
+	ctx := context.Background()
+	for name, iter := range map[string]func() (*Cursor, error){
+		"select": func() (*Cursor, error) {
+			return dml.Select("*").From("t").OrderAsc("id").Iter(ctx)
+		},
+		"select by sql": func() (*Cursor, error) {
+			return Iter(ctx, dml.SelectBySql("select * from t order by id"))
+		},
+		"union": func() (*Cursor, error) {
+			return dml.Union(
+				dml.Select("*").From("t").Where("id < ?", 3),
+				dml.Select("*").From("t").Where("id = ?", 3),
+			).Iter(ctx)
+		},
+		"declare cursor": func() (*Cursor, error) {
+			return dml.Select("*").From("t").OrderAsc("id").DeclareCursor(ctx, 2)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, err := iter()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			var rows []row
+			for c.Next() {
+				var r row
+				if err := c.Scan(&r); err != nil {
+					t.Fatal(err)
+				}
+				rows = append(rows, r)
+			}
+			if err := c.Err(); err != nil {
+				t.Fatal(err)
+			}
+			expected := []row{{base{1}, "a", ""}, {base{2}, "b", ""}, {base{3}, "c", ""}}
+			if !reflect.DeepEqual(expected, rows) {
+				t.Errorf("expected %v, got %v", expected, rows)
+			}
+		})
+	}
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		c, err := dml.Select("s").From("t").OrderAsc("id").Iter(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s string
+		if !c.Next() || c.Scan(&s) != nil || s != "a" {
+			t.Fatalf("expected the first row, got %q", s)
+		}
+		cancel()
+		if c.Next() {
+			t.Error("expected Next to stop after cancel")
+		}
+		if c.Err() != context.Canceled {
+			t.Errorf("expected %v, got %v", context.Canceled, c.Err())
+		}
+		// the connection must be released by the cursor
+		var n int
+		if _, err := dml.Select("count(*)").From("t").Load(&n); err != nil || n != 3 {
+			t.Errorf("got %v, %v", n, err)
+		}
+	})
+
+	t.Run("close context", func(t *testing.T) {
+		c, err := dml.Select("s").From("t").Iter(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.CloseContext(ctx); err != nil {
+			t.Error(err)
+		}
+		if c.Next() || c.CloseContext(ctx) != nil {
+			t.Error("expected a closed cursor")
+		}
+	})
+
+	t.Run("postgres requires a transaction", func(t *testing.T) {
+		_, err := postgres().Select("*").From("t").DeclareCursor(ctx, 10)
+		if err != ErrNotInTransaction {
+			t.Errorf("expected %v, got %v", ErrNotInTransaction, err)
+		}
+	})
+}
+
+func TestSeek(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(id integer primary key, score integer);
+		insert into t(score) values (2), (1), (2), (3), (1);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		ID    int64
+		Score int64
+	}
+	dml := Wrap(sess)
+	ctx := context.Background()
+	cases := []struct {
+		name     string
+		keys     []Key
+		expected []int64
+	}{
+		{"ascending", []Key{Asc("score"), Asc("t.id")}, []int64{2, 5, 1, 3, 4}},
+		{"descending", []Key{Desc("score"), Desc("id")}, []int64{4, 3, 1, 5, 2}},
+		{"mixed", []Key{Desc("score"), Asc("id")}, []int64{4, 1, 3, 2, 5}},
+	}
+	for _, c := range cases {
+		var ids []int64
+		var token Token
+		for pages := 0; pages == 0 || token != ""; pages++ {
+			if pages > 3 {
+				t.Fatalf("%v: too many pages", c.name)
+			}
+			var rows []row
+			token, err = dml.Select("*").From("t").Seek(token, 2, c.keys...).LoadSeek(ctx, &rows)
+			if err != nil {
+				t.Fatalf("%v: %v", c.name, err)
+			}
+			if len(rows) > 2 {
+				t.Fatalf("%v: expected at most 2 rows, got %v", c.name, rows)
+			}
+			for _, r := range rows {
+				ids = append(ids, r.ID)
+			}
+		}
+		if !reflect.DeepEqual(c.expected, ids) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.expected, ids)
+		}
+	}
+
+	var rows []row
+	token, err := dml.Select("*").From("t").Seek("", 2, Asc("id")).LoadSeek(ctx, &rows)
+	if err != nil || token == "" {
+		t.Fatalf("got %q, %v", token, err)
+	}
+	for _, invalid := range []Token{token[1:], token[:len(token)-1], "x"} {
+		_, err = dml.Select("*").From("t").Seek(invalid, 2, Asc("id")).LoadSeek(ctx, &rows)
+		if err != ErrInvalidToken {
+			t.Errorf("%q: expected %v, got %v", invalid, ErrInvalidToken, err)
+		}
+	}
+	_, err = dml.Select("*").From("t").Seek(token, 2, Desc("id")).LoadSeek(ctx, &rows)
+	if err != ErrInvalidToken {
+		t.Errorf("other keys: expected %v, got %v", ErrInvalidToken, err)
+	}
+
+	// another process, with another secret, rejects the token
+	key := tokenSecret.key
+	t.Cleanup(func() { SetTokenSecret(key) })
+	SetTokenSecret([]byte("other secret"))
+	_, err = dml.Select("*").From("t").Seek(token, 2, Asc("id")).LoadSeek(ctx, &rows)
+	if err != ErrInvalidToken {
+		t.Errorf("other secret: expected %v, got %v", ErrInvalidToken, err)
+	}
+}
+
+func TestLoadPage(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(id integer primary key, s varchar);
+		insert into t(s) values ('a'), ('b'), ('c'), ('d'), ('e');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dml := Wrap(sess)
+	ctx := context.Background()
+	cases := []struct {
+		name     string
+		stmt     func() *SelectStmt
+		page     uint64
+		expected []string
+		total    uint64
+		pages    uint64
+	}{
+		{
+			"first page",
+			func() *SelectStmt { return dml.Select("s").From("t").OrderAsc("id") },
+			1, []string{"a", "b"}, 5, 3,
+		},
+		{
+			"last page",
+			func() *SelectStmt { return dml.Select("s").From("t").OrderAsc("id") },
+			3, []string{"e"}, 5, 3,
+		},
+		{
+			"past the last page",
+			func() *SelectStmt { return dml.Select("s").From("t").OrderAsc("id") },
+			4, nil, 5, 3,
+		},
+		{
+			"with",
+			func() *SelectStmt {
+				return dml.
+					With("v", dml.Select("*").From("t").Where("id > ?", 2)).
+					Select("s").
+					From("v").
+					OrderDesc("id")
+			},
+			1, []string{"e", "d"}, 3, 2,
+		},
+	}
+	for _, c := range cases {
+		var values []string
+		p, err := c.stmt().LoadPage(ctx, &values, c.page, 2)
+		if err != nil {
+			t.Errorf("%v: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.expected, values) || p.Rows != len(c.expected) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.expected, values)
+		}
+		if p.Total != c.total || p.Pages() != c.pages {
+			t.Errorf("%v: expected %v rows in %v pages, got %+v", c.name, c.total, c.pages, p)
+		}
+	}
+	var values []string
+	_, err = dml.Select("s").From("t").LoadPage(ctx, &values, 0, 2)
+	if err != ErrInvalidValue {
+		t.Errorf("expected %v, got %v", ErrInvalidValue, err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(id integer primary key, dept varchar, salary integer);
+		insert into t(dept, salary) values ('a', 10), ('a', 20), ('b', 30), ('b', 30);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dml := Wrap(sess)
+	var ranks []int64
+	_, err = dml.
+		Select("rank() OVER w").
+		From("t").
+		Window("w", "PARTITION BY dept ORDER BY salary DESC").
+		OrderAsc("id").
+		Limit(3).
+		Offset(1).
+		Load(&ranks)
+	if err != nil || !reflect.DeepEqual([]int64{1, 1, 1}, ranks) {
+		t.Errorf("window: got %v, %v", ranks, err)
+	}
+	var depts []string
+	_, err = dml.
+		With("v", dml.Select("*").From("t")).
+		Select("dept").
+		From("v").
+		GroupBy("dept").
+		Having("sum(salary) > ?", 30).
+		Load(&depts)
+	if err != nil || !reflect.DeepEqual([]string{"b"}, depts) {
+		t.Errorf("group by: got %v, %v", depts, err)
+	}
+	_, err = dml.Select("*").From("t").DistinctOn("dept").Load(&depts)
+	if err != ErrNotSupported {
+		t.Errorf("distinct on: expected %v, got %v", ErrNotSupported, err)
+	}
+	err = RunInTransaction(dml, func(tx TX) error {
+		_, err := tx.Select("*").From("t").ForUpdate().Load(&depts)
+		return err
+	})
+	if err != ErrNotSupported {
+		t.Errorf("for update: expected %v, got %v", ErrNotSupported, err)
+	}
+	buf := dbr.NewBuffer()
+	err = postgres().Select("*").From("t").ForKeyShare().Build(dbrdialect.PostgreSQL, buf)
+	if err != ErrNotInTransaction {
+		t.Errorf("for key share: expected %v, got %v", ErrNotInTransaction, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(id integer primary key, org integer, n integer, s varchar);
+		insert into t(org, n, s) values (1, 0, 'a'), (2, 0, 'b'), (2, 0, 'c'), (2, 0, 'd');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dml := Wrap(sess)
+	_, err = dml.Update("t").Set("s", "x").Where("id = ? AND org = ?", 1, 1).Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := dml.
+		Update("t").
+		Increment("n", 2).
+		SetExpr("s", "upper(s)").
+		Where("org = ?", 2).
+		Limit(2).
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("expected 2 rows affected, got %v", n)
+	}
+	type row struct {
+		N int64
+		S string
+	}
+	var rows []row
+	_, err = dml.Select("n", "s").From("t").OrderAsc("id").Load(&rows)
+	expected := []row{{0, "x"}, {2, "B"}, {2, "C"}, {0, "d"}}
+	if err != nil || !reflect.DeepEqual(expected, rows) {
+		t.Errorf("expected %v, got %v, %v", expected, rows, err)
+	}
+
+	_, err = dml.
+		Update("t").
+		Set("s", dbr.I("v.s")).
+		Set("org", 3).
+		From(Values(1, "y").Values(4, "z").As("v", "id", "s")).
+		Where("t.id = v.id").
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dml.
+		DeleteFrom("t").
+		Using(dml.Select("*").From("t").As("o")).
+		Where("o.id = t.id + 1 AND o.s = ?", "C").
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type org struct {
+		Org int64
+		S   string
+	}
+	var orgs []org
+	_, err = dml.Select("org", "s").From("t").OrderAsc("id").Load(&orgs)
+	expectedOrgs := []org{{3, "y"}, {2, "C"}, {3, "z"}}
+	if err != nil || !reflect.DeepEqual(expectedOrgs, orgs) {
+		t.Errorf("expected %v, got %v, %v", expectedOrgs, orgs, err)
+	}
+}
+
+func TestUpsertRecords(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the batches run in a transaction, which must see the same database
+	conn.SetMaxOpenConns(1)
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(code varchar primary key, name varchar, n integer, created varchar);
+		insert into t values ('a', 'old', 0, 'yesterday');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type record struct {
+		Code    string
+		Name    string
+		N       int64
+		Created string
+	}
+	dml := Wrap(sess)
+	res, err := dml.
+		InsertInto("t").
+		Records([]record{{"a", "new", 1, "today"}, {"b", "new", 2, "today"}}).
+		OnConflict("code", nil).
+		DoUpdateAll("created").
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("expected 2 rows affected, got %v", n)
+	}
+	var records []record
+	_, err = dml.Select("*").From("t").OrderAsc("code").Load(&records)
+	expected := []record{{"a", "new", 1, "yesterday"}, {"b", "new", 2, "today"}}
+	if err != nil || !reflect.DeepEqual(expected, records) {
+		t.Errorf("expected %v, got %v, %v", expected, records, err)
+	}
+
+	_, err = dml.
+		InsertInto("t").
+		Record(&record{Code: "a", Name: "ignored"}).
+		OnConflict("code", nil).
+		Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records = make([]record, 40000)
+	for i := range records {
+		records[i] = record{Code: fmt.Sprint(i), Name: "batch"}
+	}
+	stmt := dml.InsertInto("t").Columns("code", "name").Records(records).OnConflict("code", nil).DoUpdateAll()
+	batches := stmt.batches()
+	if len(batches) != 81 {
+		t.Errorf("expected 81 batches, got %v", len(batches))
+	}
+	for _, batch := range batches {
+		if n := len(batch.InsertStmt.Value) * len(batch.Column); n > 999 {
+			t.Errorf("expected at most 999 parameters, got %v", n)
+		}
+	}
+	res, err = stmt.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 40000 {
+		t.Errorf("expected 40000 rows affected, got %v", n)
+	}
+	var count int
+	_, err = dml.Select("count(*)").From("t").Where("name = ?", "batch").Load(&count)
+	if err != nil || count != 40000 {
+		t.Errorf("expected 40000 rows, got %v, %v", count, err)
+	}
+}
+
+func TestInsertBatches(t *testing.T) {
+	sqlite := Wrap(&dbr.Session{
+		Connection: &dbr.Connection{
+			Dialect:       dbrdialect.SQLite3,
+			EventReceiver: &dbr.NullEventReceiver{},
+		},
+		EventReceiver: &dbr.NullEventReceiver{},
+	})
+	cases := []struct {
+		name  string
+		dml   DML
+		rows  int
+		sizes []int
+	}{
+		{"postgres limit", postgres(), 32767, []int{32767}},
+		{"postgres over limit", postgres(), 32768, []int{32767, 1}},
+		{"sqlite limit", sqlite, 499, []int{499}},
+		{"sqlite over limit", sqlite, 500, []int{499, 1}},
+	}
+	for _, c := range cases {
+		stmt := c.dml.InsertInto("t").Columns("a", "b")
+		for i := 0; i < c.rows; i++ {
+			stmt.Values(i, i)
+		}
+		var sizes []int
+		for _, batch := range stmt.batches() {
+			sizes = append(sizes, len(batch.InsertStmt.Value))
+		}
+		if !reflect.DeepEqual(c.sizes, sizes) {
+			t.Errorf("%v: expected %v, got %v", c.name, c.sizes, sizes)
+		}
+	}
+}
+
+func TestInsertRecord(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`create table t(id integer primary key, name varchar)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type record struct {
+		ID   int64
+		Name string
+	}
+	dml := Wrap(sess)
+	if stmt := dml.InsertInto("t").Record(nil); len(stmt.Column) != 0 || len(stmt.InsertStmt.Value) != 0 {
+		t.Errorf("expected an empty insert, got %v, %v", stmt.Column, stmt.InsertStmt.Value)
+	}
+	if stmt := dml.InsertInto("t").Record(record{ID: 7, Name: "a"}); !reflect.DeepEqual(stmt.Column, []string{"id", "name"}) {
+		t.Errorf("expected the id column, got %v", stmt.Column)
+	}
+
+	records := []record{{Name: "a"}, {Name: "b"}}
+	stmt := dml.InsertInto("t").Records(records)
+	if !reflect.DeepEqual(stmt.Column, []string{"name"}) {
+		t.Errorf("expected the zero id to be skipped, got %v", stmt.Column)
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records[1].ID != 2 {
+		t.Errorf("expected the id of the last record, got %v", records)
+	}
+	_, err = dml.InsertInto("t").Record(&record{Name: "c"}).Exec()
+	if err != nil {
+		t.Errorf("expected a new id, got %v", err)
+	}
+	for _, mixed := range [][]record{{{Name: "d"}, {ID: 10, Name: "e"}}, {{ID: 11, Name: "f"}, {Name: "g"}}} {
+		_, err = dml.InsertInto("t").Records(mixed).Exec()
+		if err != ErrColumnsMismatch {
+			t.Errorf("%v: expected %v, got %v", mixed, ErrColumnsMismatch, err)
+		}
+	}
+	var count int
+	_, err = dml.Select("count(*)").From("t").Load(&count)
+	if err != nil || count != 3 {
+		t.Errorf("expected 3 rows, got %v, %v", count, err)
+	}
+}
+
+func TestDoUpdate(t *testing.T) {
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := conn.NewSession(nil)
+	_, err = sess.Exec(`
+		create table t(id integer primary key, n integer, s varchar, c varchar);
+		insert into t values (1, 1, 'a', 'a');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dml := Wrap(sess)
+	stmt := dml.
+		InsertInto("t").
+		Columns("id", "n", "s", "c").
+		Values(1, 5, "z", "z").
+		OnConflict("id", DoUpdate().
+			SetExcluded("s").
+			SetExpr("n", dbr.Expr("t.n + EXCLUDED.n")).
+			Set("c", "b"))
+	str, err := interpolate(stmt, dbrdialect.SQLite3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `INSERT INTO "t" ("id","n","s","c") VALUES (1,5,'z','z') ON CONFLICT ("id") DO UPDATE SET "s" = EXCLUDED."s", "n" = t.n + EXCLUDED.n, "c" = 'b'`
+	if str != expected {
+		t.Errorf("expected\n%v,\ngot\n%v.", expected, str)
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		ID int64
+		N  int64
+		S  string
+		C  string
+	}
+	var r row
+	err = dml.Select("*").From("t").LoadOne(&r)
+	if err != nil || r != (row{1, 6, "z", "b"}) {
+		t.Errorf("got %v, %v", r, err)
+	}
+}
+
+func TestBind(t *testing.T) {
+	pg := postgres()
+	cases := []struct {
+		name     string
+		builder  dbr.Builder
+		expected string
+		args     []interface{}
+	}{
+		{
+			"placeholders",
+			pg.With("v", pg.Select("*").From("t").Where("a = ?", 1)).Select("*").From("v").Where("b = ?", "x"),
+			`WITH v AS (SELECT * FROM "t" WHERE (a = $1)) SELECT * FROM "v" WHERE (b = $2)`,
+			[]interface{}{1, "x"},
+		},
+		{
+			"slice",
+			pg.Select("*").From("t").Where("a IN ?", []int{1, 2}).Where("b IN ?", []string{}).DistinctOn("a"),
+			`SELECT DISTINCT ON (a) * FROM "t" WHERE (a IN ($1,$2)) AND (b IN (NULL))`,
+			[]interface{}{1, 2},
+		},
+		{
+			"with values",
+			pg.With("v(id, c)", Values(1, "a").Values(2, "b")).Select("*").From("v").Where("id = ?", 2),
+			`WITH v(id, c) AS (VALUES ($1::bigint,$2::text),($3,$4)) SELECT * FROM "v" WHERE (id = $5)`,
+			[]interface{}{1, "a", 2, "b", 2},
+		},
+		{
+			"typed values",
+			pg.Select("*").From(Values(1, nil).Values(2, "b").Types("integer", "varchar").As("v", "id", "c")),
+			`SELECT * FROM (VALUES ($1::integer,$2::varchar),($3,$4)) AS "v" ("id", "c")`,
+			[]interface{}{1, nil, 2, "b"},
+		},
+		{
+			"update from values",
+			pg.Update("t").Set("c", dbr.I("v.c")).
+				From(Values(1, "a").Values(2, "b").As("v", "id", "c")).
+				Where("t.id = v.id AND t.c <> ?", "x"),
+			`UPDATE "t" SET "c" = "v"."c" FROM (VALUES ($1::bigint,$2::text),($3,$4)) AS "v" ("id", "c") WHERE (t.id = v.id AND t.c <> $5)`,
+			[]interface{}{1, "a", 2, "b", "x"},
+		},
+		{
+			"quoted placeholders",
+			pg.Select(`"a?"`).From("t").Where("b = '?''?' AND c = ?", 1),
+			`SELECT "a?" FROM "t" WHERE (b = '?''?' AND c = $1)`,
+			[]interface{}{1},
+		},
+		{
+			"subquery",
+			pg.Select("*").From("t").Where("a IN ?", pg.Select("a").From("u").Where("c = ?", 3)).Where("b = ?", []byte("y")),
+			`SELECT * FROM "t" WHERE (a IN (SELECT a FROM "u" WHERE (c = $1))) AND (b = $2)`,
+			[]interface{}{3, []byte("y")},
+		},
+	}
+	for _, c := range cases {
+		query, args, err := bind(c.builder, dbrdialect.PostgreSQL)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if query != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, query)
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.args, args)
+		}
+	}
+
+	conn, err := dbr.Open("sqlite3", ":memory:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sessions must see the same database
+	conn.SetMaxOpenConns(1)
+	log := &timingReceiver{}
+	dml := Wrap(conn.NewSession(log))
+	_, err = dml.Exec(`create table t(id integer primary key, data blob)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dml.InsertInto("t").Columns("id", "data").
+		Values(1, []byte("a")).Values(2, []byte("b")).Values(3, []byte("c")).
+		OnConflict("id", nil).Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, interpolate := range []bool{false, true} {
+		// the options are kept by each session
+		dml := WrapOptions(conn.NewSession(log), Options{Interpolate: interpolate})
+		var data [][]byte
+		_, err = dml.With("v", dml.Select("*").From("t").Where("id IN ?", []int64{1, 3})).
+			Select("data").From("v").Where("data <> ?", []byte("b")).OrderAsc("id").Load(&data)
+		if err != nil || !reflect.DeepEqual(data, [][]byte{[]byte("a"), []byte("c")}) {
+			t.Errorf("interpolate %v: got %q, %v", interpolate, data, err)
+		}
+		timed := log.timings["dbr.select"]
+		if !interpolate && !strings.HasPrefix(timed, `WITH v AS (SELECT * FROM "t" WHERE (id IN (?,?)))`) {
+			t.Errorf("expected the bound query to be timed, got %v", timed)
+		}
+		var ids []int64
+		_, err = dml.Union(
+			dml.Select("id").From("t").Where("id = ?", 1),
+			dml.Select("id").From("t").Where("data = ?", []byte("c")),
+		).Load(&ids)
+		if err != nil || !reflect.DeepEqual(ids, []int64{1, 3}) {
+			t.Errorf("interpolate %v: got %v, %v", interpolate, ids, err)
+		}
+		var n int
+		_, err = dml.With("v", dml.Select("id").From("t")).
+			Select("COUNT(*)").From("v").Where("'?' <> ? AND id > ?", "x", 1).Load(&n)
+		if err != nil || n != 2 {
+			t.Errorf("interpolate %v: got %v, %v", interpolate, n, err)
+		}
+	}
+
+	// the rows outlive the session timeout
+	sess := conn.NewSession(nil)
+	sess.Timeout = 10 * time.Millisecond
+	rows, err := Wrap(sess).With("v", sess.Select("id").From("t")).Select("id").From("v").Rows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	time.Sleep(20 * time.Millisecond)
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if rows.Err() != nil || n != 3 {
+		t.Errorf("expected 3 rows, got %v, %v", n, rows.Err())
+	}
+}
+
+// timingReceiver records the last sql timed for each event
+type timingReceiver struct {
+	dbr.NullEventReceiver
+	timings map[string]string
+}
+
+func (r *timingReceiver) TimingKv(eventName string, nanoseconds int64, kvs map[string]string) {
+	if r.timings == nil {
+		r.timings = make(map[string]string)
+	}
+	r.timings[eventName] = kvs["sql"]
 }
@@ -1,6 +1,9 @@
 package dbrx
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 // package errors
 var (
@@ -14,4 +17,24 @@ var (
 	ErrCantConvertToTime  = errors.New("dbr: can't convert to time.Time")
 	ErrInvalidTimestring  = errors.New("dbr: invalid time string")
 	ErrInvalidValue       = errors.New("dbrx: invalid value")
+	ErrNotInTransaction   = errors.New("dbrx: not in a transaction")
+	ErrInvalidToken       = errors.New("dbrx: invalid pagination token")
+	ErrColumnsMismatch    = errors.New("dbrx: records with different columns")
+	ErrWithConflict       = errors.New("dbrx: different with clauses with the same name")
 )
+
+// PanicError is returned by functions wrapped with RecoverPanic when they panic
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("dbrx: panic in transaction: %v", e.Value)
+}
+
+// Unwrap returns the panic value, if it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
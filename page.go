@@ -0,0 +1,132 @@
+package dbrx
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// Page is a page of the results of a query, loaded with LoadPage
+type Page struct {
+	// Number is the page number, starting at 1
+	Number uint64
+	// Size is the maximum number of rows in a page
+	Size uint64
+	// Rows is the number of rows loaded
+	Rows int
+	// Total is the number of rows returned by the query without pagination
+	Total uint64
+}
+
+// Pages returns the number of pages
+func (p *Page) Pages() uint64 {
+	if p.Size == 0 {
+		return 0
+	}
+	return (p.Total + p.Size - 1) / p.Size
+}
+
+const totalColumn = "dbrx_total"
+
+// LoadPage loads the page-th page, of size rows, into value, a pointer to a
+// slice, and counts the rows of the whole query. On PostgreSQL the count is
+// loaded with the rows, using COUNT(*) OVER(); distinct queries and the
+// other dialects run a separate SELECT COUNT(*) FROM (<stmt>).
+func (b *SelectStmt) LoadPage(ctx context.Context, value interface{}, page, size uint64) (*Page, error) {
+	if page < 1 || size < 1 {
+		return nil, ErrInvalidValue
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return nil, ErrInvalidPointer
+	}
+	p := &Page{Number: page, Size: size}
+	stmt := *b.SelectStmt
+	stmt.Paginate(page, size)
+	// window functions run before DISTINCT, so they would count duplicates,
+	// and can't be used with locking clauses
+	if !isPostgres(b.Dialect) || stmt.IsDistinct || len(b.distinctOn) > 0 || b.lock != nil {
+		n, err := b.copy(&stmt).LoadContext(ctx, value)
+		if err != nil {
+			return nil, err
+		}
+		p.Rows = n
+		p.Total, err = b.count(ctx)
+		return p, err
+	}
+
+	stmt.Column = append(stmt.Column[:len(stmt.Column):len(stmt.Column)], "COUNT(*) OVER() AS "+totalColumn)
+	rows, err := b.copy(&stmt).RowsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	for rows.Next() {
+		elem := reflect.New(elemType)
+		target := elem
+		if elemType.Kind() == reflect.Ptr {
+			elem.Elem().Set(reflect.New(elemType.Elem()))
+			target = elem.Elem()
+		}
+		targets, err := scanTargets(target.Interface(), columns[:len(columns)-1])
+		if err != nil {
+			return nil, err
+		}
+		err = rows.Scan(append(targets, &p.Total)...)
+		if err != nil {
+			return nil, err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+		p.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if p.Rows == 0 && page > 1 {
+		// past the last page there is no row to carry the count
+		p.Total, err = b.count(ctx)
+	}
+	return p, err
+}
+
+// copy returns a copy of b that runs stmt
+func (b *SelectStmt) copy(stmt *dbr.SelectStmt) *SelectStmt {
+	c := *b
+	c.SelectStmt = stmt
+	return &c
+}
+
+// count returns the number of rows returned by b, ignoring its order, limit
+// and offset
+func (b *SelectStmt) count(ctx context.Context) (uint64, error) {
+	stmt := *b.SelectStmt
+	stmt.Order = nil
+	stmt.LimitCount = -1
+	stmt.OffsetCount = -1
+	count := dbr.BuildFunc(func(d dbr.Dialect, buf dbr.Buffer) error {
+		err := b.withClauses.write(d, buf)
+		if err != nil {
+			return err
+		}
+		buf.WriteString("SELECT COUNT(*) FROM (")
+		inner := b.copy(&stmt)
+		inner.withClauses = nil
+		inner.lock = nil
+		err = inner.Build(d, buf)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(") AS dbrx_count")
+		return nil
+	})
+	var total uint64
+	_, err := loadContext(ctx, b.dml, b.Dialect, count, &total)
+	return total, err
+}
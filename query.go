@@ -0,0 +1,55 @@
+package dbrx
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// Loader is implemented by the statements that load query results, like
+// *SelectStmt, *UnionStmt and the *dbr.SelectStmt returned by SelectBySql
+type Loader interface {
+	LoadContext(ctx context.Context, value interface{}) (int, error)
+}
+
+// All loads every row returned by q into a slice of T
+func All[T any](ctx context.Context, q Loader) ([]T, error) {
+	var values []T
+	_, err := q.LoadContext(ctx, &values)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// One loads the first row returned by q into a T. It returns ErrNotFound if
+// there are no rows.
+func One[T any](ctx context.Context, q Loader) (T, error) {
+	var value T
+	n, err := q.LoadContext(ctx, &value)
+	if errors.Is(err, dbr.ErrNotFound) || (err == nil && n == 0) {
+		return value, ErrNotFound
+	}
+	return value, err
+}
+
+// Maybe loads the first row returned by q into a T, like One, but returns
+// nil instead of ErrNotFound if there are no rows
+func Maybe[T any](ctx context.Context, q Loader) (*T, error) {
+	value, err := One[T](ctx, q)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// Scalar loads the single column of the first row returned by q, as in
+// Scalar[int64](ctx, dml.Select("count(*)").From("t")). It returns
+// ErrNotFound if there are no rows.
+func Scalar[T any](ctx context.Context, q Loader) (T, error) {
+	return One[T](ctx, q)
+}
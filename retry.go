@@ -0,0 +1,122 @@
+package dbrx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// RetryPolicy configures how RunInTransactionWithRetry runs a transaction
+// again after it fails
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the transaction is run
+	MaxAttempts int
+	// Backoff is the base delay before a new attempt. It doubles after each
+	// attempt and is randomized to keep concurrent transactions apart.
+	Backoff time.Duration
+	// MaxBackoff limits the delay before a new attempt
+	MaxBackoff time.Duration
+	// IsRetryable reports whether an attempt failed with an error that may
+	// not happen again. Defaults to IsRetryable.
+	IsRetryable func(err error) bool
+}
+
+// DefaultRetryPolicy runs a transaction up to 5 times when it fails because
+// of serialization failures, deadlocks or busy databases
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     10 * time.Millisecond,
+	MaxBackoff:  time.Second,
+	IsRetryable: IsRetryable,
+}
+
+// IsRetryable reports whether err is a PostgreSQL serialization failure
+// (SQLSTATE 40001) or deadlock (SQLSTATE 40P01), or a SQLite SQLITE_BUSY error
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	// implemented by the pgx and lib/pq errors
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		switch pgErr.SQLState() {
+		case "40001", "40P01":
+			return true
+		}
+		return false
+	}
+	// go-sqlite3 error message for SQLITE_BUSY
+	return strings.Contains(err.Error(), "database is locked")
+}
+
+// RunInTransactionWithRetry calls f inside a transaction, like
+// RunInTransactionContext, and runs it again in a fresh transaction while it
+// fails with retryable errors. Functions registered with RunAfterCommit run
+// only for the attempt that commits.
+//
+// If dml is already a transaction, the failure aborts the enclosing
+// transaction too, so f runs only once and the error is returned to be
+// retried by the enclosing transaction owner.
+func RunInTransactionWithRetry(
+	ctx context.Context,
+	dml DML,
+	opts *sql.TxOptions,
+	policy RetryPolicy,
+	f func(ctx context.Context, tx TX) error,
+) error {
+	if _, ok := asTX(dml); ok {
+		return RunInTransactionContext(ctx, dml, opts, f)
+	}
+	isRetryable := policy.IsRetryable
+	if isRetryable == nil {
+		isRetryable = IsRetryable
+	}
+	for attempt := 1; ; attempt++ {
+		err := RunInTransactionContext(ctx, dml, opts, f)
+		if err == nil || attempt >= policy.MaxAttempts || !isRetryable(err) {
+			return err
+		}
+		if err := sleep(ctx, policy.backoff(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before the attempt following the given one,
+// randomized between half and the whole exponential backoff
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if attempt > 30 {
+		attempt = 30
+	}
+	shift := uint(attempt - 1)
+	d := p.Backoff << shift
+	overflow := p.Backoff > 0 && (d <= 0 || d>>shift != p.Backoff)
+	if overflow {
+		d = math.MaxInt64
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 1 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,307 @@
+package dbrx
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gocraft/dbr/v2"
+)
+
+// Key is a column of a keyset (seek) pagination. The keys together must
+// identify a row, so the last one is usually the primary key.
+type Key struct {
+	Column string
+	Desc   bool
+}
+
+// Asc returns an ascending pagination key
+func Asc(column string) Key {
+	return Key{Column: column}
+}
+
+// Desc returns a descending pagination key
+func Desc(column string) Key {
+	return Key{Column: column, Desc: true}
+}
+
+// Token is an opaque, signed continuation token, pointing to the last row
+// of a page. The zero value points to the first page.
+type Token string
+
+type seek struct {
+	keys  []Key
+	limit int
+}
+
+var tokenSecret = struct {
+	sync.RWMutex
+	key []byte
+}{key: randomKey()}
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// SetTokenSecret sets the key used to sign pagination tokens. The default is
+// random, so tokens are only valid within the process that issued them. Set
+// the same key on every replica, before serving requests.
+func SetTokenSecret(key []byte) {
+	tokenSecret.Lock()
+	defer tokenSecret.Unlock()
+	tokenSecret.key = append([]byte(nil), key...)
+}
+
+// Seek paginates the query by keys, returning limit rows after the one
+// pointed by the token, which is returned by LoadSeek. Use it instead of
+// Paginate, that uses OFFSET, to page over large or changing results:
+//
+//	stmt := dml.Select("*").From("posts").Seek(after, 20, Desc("created_at"), Asc("id"))
+//	next, err := stmt.LoadSeek(ctx, &posts)
+//
+// The tokens are signed with the key set by SetTokenSecret. Without it, they
+// are signed with a random key, so a token issued before a restart, or by
+// another replica, is rejected: the statement fails with ErrInvalidToken,
+// which should be handled by starting over from the first page.
+func (b *SelectStmt) Seek(after Token, limit int, keys ...Key) *SelectStmt {
+	if len(keys) == 0 || limit <= 0 {
+		b.err = ErrInvalidValue
+		return b
+	}
+	if after != "" {
+		values, err := decodeToken(after, keys)
+		if err != nil {
+			b.err = err
+			return b
+		}
+		b.SelectStmt.Where(seekCond(keys, values))
+	}
+	for _, k := range keys {
+		b.SelectStmt.OrderDir(k.Column, !k.Desc)
+	}
+	// one more row tells if there is a next page
+	b.SelectStmt.Limit(uint64(limit) + 1)
+	b.seek = &seek{keys, limit}
+	return b
+}
+
+// LoadSeek loads a page of a query paginated with Seek into value, a pointer
+// to a slice of structs, and returns the token to the next page, or an
+// empty token if this is the last one
+func (b *SelectStmt) LoadSeek(ctx context.Context, value interface{}) (Token, error) {
+	if b.seek == nil {
+		return "", ErrInvalidValue
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return "", ErrInvalidPointer
+	}
+	_, err := b.LoadContext(ctx, value)
+	if err != nil {
+		return "", err
+	}
+	v = v.Elem()
+	if v.Len() <= b.seek.limit {
+		return "", nil
+	}
+	v.SetLen(b.seek.limit)
+	return encodeToken(b.seek.keys, v.Index(b.seek.limit-1))
+}
+
+// seekCond returns the condition selecting the rows after values. It uses
+// a row value comparison when all keys have the same direction.
+func seekCond(keys []Key, values []interface{}) dbr.Builder {
+	sameDir := true
+	for _, k := range keys[1:] {
+		sameDir = sameDir && k.Desc == keys[0].Desc
+	}
+	if sameDir {
+		op := " > "
+		if keys[0].Desc {
+			op = " < "
+		}
+		cols := make([]interface{}, len(keys))
+		for i, k := range keys {
+			cols[i] = dbr.I(k.Column)
+		}
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+		if len(keys) == 1 {
+			return dbr.Expr(marks+op+marks, append(cols, values...)...)
+		}
+		return dbr.Expr("("+marks+")"+op+"("+marks+")", append(cols, values...)...)
+	}
+	// (a > ?) OR (a = ? AND b < ?) OR ...
+	or := make([]dbr.Builder, len(keys))
+	for i, k := range keys {
+		and := make([]dbr.Builder, 0, i+1)
+		for j := 0; j < i; j++ {
+			and = append(and, dbr.Eq(keys[j].Column, values[j]))
+		}
+		if k.Desc {
+			and = append(and, dbr.Lt(k.Column, values[i]))
+		} else {
+			and = append(and, dbr.Gt(k.Column, values[i]))
+		}
+		or[i] = dbr.And(and...)
+	}
+	return dbr.Or(or...)
+}
+
+type tokenPayload struct {
+	Keys   []string    `json:"k"`
+	Values [][2]string `json:"v"`
+}
+
+func tokenKeys(keys []Key) []string {
+	s := make([]string, len(keys))
+	for i, k := range keys {
+		s[i] = k.Column
+		if k.Desc {
+			s[i] += " DESC"
+		}
+	}
+	return s
+}
+
+func sign(payload []byte) []byte {
+	tokenSecret.RLock()
+	defer tokenSecret.RUnlock()
+	mac := hmac.New(sha256.New, tokenSecret.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// encodeToken returns the token pointing to row, a struct mapped like dbr
+// does, with a field for each key column
+func encodeToken(keys []Key, row reflect.Value) (Token, error) {
+	for row.Kind() == reflect.Ptr {
+		row = row.Elem()
+	}
+	if !isStruct(row.Type()) {
+		return "", ErrInvalidPointer
+	}
+	fields := structFields(row.Type())
+	payload := tokenPayload{Keys: tokenKeys(keys)}
+	for _, k := range keys {
+		name := k.Column[strings.LastIndex(k.Column, ".")+1:]
+		index, ok := fields[strings.Trim(name, "\"`")]
+		if !ok {
+			return "", ErrColumnNotSpecified
+		}
+		value, err := encodeValue(fieldByIndex(row, index).Interface())
+		if err != nil {
+			return "", err
+		}
+		payload.Values = append(payload.Values, value)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return Token(enc.EncodeToString(data) + "." + enc.EncodeToString(sign(data))), nil
+}
+
+// decodeToken checks the token signature and returns its values, which must
+// have been encoded for the same keys
+func decodeToken(token Token, keys []Key) ([]interface{}, error) {
+	enc := base64.RawURLEncoding
+	parts := strings.SplitN(string(token), ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+	data, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac, err := enc.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, sign(data)) {
+		return nil, ErrInvalidToken
+	}
+	var payload tokenPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !reflect.DeepEqual(payload.Keys, tokenKeys(keys)) || len(payload.Values) != len(keys) {
+		return nil, ErrInvalidToken
+	}
+	values := make([]interface{}, len(payload.Values))
+	for i, v := range payload.Values {
+		values[i], err = decodeValue(v)
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+	}
+	return values, nil
+}
+
+// encodeValue tags a key value with its type, so it is decoded to the same
+// type. Keys can't be null.
+func encodeValue(value interface{}) ([2]string, error) {
+	if valuer, ok := value.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return [2]string{}, err
+		}
+		value = v
+	}
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Kind() == reflect.Ptr {
+		return [2]string{}, ErrInvalidValue
+	}
+	switch x := v.Interface().(type) {
+	case time.Time:
+		return [2]string{"t", x.Format(time.RFC3339Nano)}, nil
+	case []byte:
+		return [2]string{"b", base64.StdEncoding.EncodeToString(x)}, nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return [2]string{"s", v.String()}, nil
+	case reflect.Bool:
+		return [2]string{"B", strconv.FormatBool(v.Bool())}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return [2]string{"i", strconv.FormatInt(v.Int(), 10)}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return [2]string{"u", strconv.FormatUint(v.Uint(), 10)}, nil
+	case reflect.Float32, reflect.Float64:
+		return [2]string{"f", strconv.FormatFloat(v.Float(), 'g', -1, 64)}, nil
+	}
+	return [2]string{}, ErrInvalidValue
+}
+
+func decodeValue(v [2]string) (interface{}, error) {
+	switch v[0] {
+	case "t":
+		return time.Parse(time.RFC3339Nano, v[1])
+	case "b":
+		return base64.StdEncoding.DecodeString(v[1])
+	case "s":
+		return v[1], nil
+	case "B":
+		return strconv.ParseBool(v[1])
+	case "i":
+		return strconv.ParseInt(v[1], 10, 64)
+	case "u":
+		return strconv.ParseUint(v[1], 10, 64)
+	case "f":
+		return strconv.ParseFloat(v[1], 64)
+	}
+	return nil, ErrInvalidToken
+}